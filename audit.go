@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	auditWriter *csv.Writer
+	auditMu     sync.Mutex
+)
+
+//Open the CSV audit trail for appending when AuditFile is set, writing the header row if the file is new
+func openAudit() error {
+	if config.AuditFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(config.AuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+
+	auditWriter = csv.NewWriter(f)
+	if info.Size() == 0 {
+		auditWriter.Write([]string{"timestamp", "action", "username", "group", "result"})
+		auditWriter.Flush()
+	}
+	return nil
+}
+
+//Note a membership change in the run summary and append it to the audit trail. result is success, failed or dry-run
+func recordChange(action, user, group, result string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if result != "failed" {
+		stats.changes = append(stats.changes, fmt.Sprintf("%s %s %s", action, user, group))
+	} else {
+		if stats.failed == nil {
+			stats.failed = make(map[string]struct{})
+		}
+		stats.failed[action+"\x00"+user+"\x00"+group] = struct{}{}
+	}
+
+	if auditWriter == nil || probing() {
+		return
+	}
+
+	auditWriter.Write([]string{time.Now().Format(time.RFC3339), action, user, group, result})
+	auditWriter.Flush()
+	if err := auditWriter.Error(); err != nil {
+		writeError(fmt.Errorf("unable to write audit record: %w", err))
+	}
+}
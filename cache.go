@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//The result of one user search, kept so later pairs in the same run and daemon cycles within UserCacheTTL can
+//skip the search
+type cachedUsers struct {
+	users   []directoryUser
+	fetched time.Time
+}
+
+//Cached user searches keyed by the DN, scope, filter and attributes searched. The sync loop reads and writes it
+//from a single goroutine and the daemon clears it between cycles, so it needs no locking
+var userCache = make(map[string]cachedUsers)
+
+//Return the users matching filter within scope of dn along with attrs. A search is reused when it ran earlier
+//in this run, which lets several rules share one search, or when it is younger than UserCacheTTL
+func cachedListUsers(dc directoryClient, dn string, scope int, filter string, attrs []string) ([]directoryUser, error) {
+	ttl := time.Duration(config.ActiveDirectory.UserCacheTTL) * time.Second
+
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", dn, scope, filter, strings.Join(attrs, ","))
+	if x, ok := userCache[key]; ok && (!x.fetched.Before(stats.start) || time.Since(x.fetched) < ttl) {
+		writeDebug("Reusing the cached user list for " + dn)
+		return x.users, nil
+	}
+
+	users, err := dc.ListUsers(dn, scope, filter, attrs)
+	if err != nil {
+		return nil, err
+	}
+	userCache[key] = cachedUsers{users: users, fetched: time.Now()}
+	return users, nil
+}
+
+//Drop every cached user search so the next cycle queries the directory again
+func clearUserCache() {
+	userCache = make(map[string]cachedUsers)
+}
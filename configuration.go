@@ -1,17 +1,745 @@
 package main
 
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
 type Configuration struct {
 	ActiveDirectory struct {
-		Host     string
-		Domain   string
-		Username string
-		Password string
-		UserDN   string
-		GroupDN  string
-		Group    string
+		//Connection is the directory holding the groups, and the users unless source.activeDirectory is set
+		Connection `mapstructure:",squash"`
+		//UserDN, GroupDN and Group describe a single sync pair and are used when Mappings is empty
+		UserDN  string
+		GroupDN string
+		Group   string
+		//Mappings lists every OU to group pair to synchronize in one run
+		Mappings []SyncPair
+		//Rules route the users under UserDN into groups by attribute value or expression, sharing one user search
+		Rules []Rule
+		//UserCacheTTL in seconds reuses each OU's user list across daemon cycles for this long, zero searches
+		//every cycle. Group membership is always read fresh, and SIGHUP clears the cache
+		UserCacheTTL int
+		//Recursive includes users in child OUs of UserDN. Searching the whole subtree is slower on
+		//large directories since every nested OU is walked, but results are still paged
+		Recursive bool
+		//BatchSize is the most members added by a single modify request, defaults to 500
+		BatchSize int
+		//Concurrency is how many modify requests run in parallel over the shared connection, defaults to 1
+		Concurrency int
+		//UserFilter replaces the default (objectClass=user) user search filter, for example with
+		//(objectClass=inetOrgPerson) on other LDAP directories
+		UserFilter string
+		//ExtraUserFilter is ANDed with the user search filter to narrow the users synchronized
+		ExtraUserFilter string
+		//ObjectClasses builds the search filter from the kinds of object to synchronize, any of user, contact,
+		//computer or inetOrgPerson, in place of UserFilter. user then no longer matches computers
+		ObjectClasses []string
+		//SkipDisabled leaves disabled accounts out of the sync. Objects without userAccountControl, such as
+		//contacts, are never treated as disabled
+		SkipDisabled bool
+		//ExcludeExpired leaves accounts past their accountExpires time out of the sync. ExpiredSkew is a
+		//tolerance in seconds for clock differences, an account only counts as expired once it is this far past
+		ExcludeExpired bool
+		ExpiredSkew    int
+		//ExcludeUsers lists accounts that are never added to the group, by DN, CN or account name, by a
+		//wildcard pattern such as svc_* or *,OU=Shared Mailboxes,*, or by a regular expression over the account
+		//name written between slashes such as /^svc-|-admin$/
+		ExcludeUsers []string
+		//IncludeUsers, when set, limits the users added to the group to those listed, matched the same way.
+		//ExcludeUsers still wins for an account in both lists
+		IncludeUsers []string
+		//MatchByAccountName compares users and group members by sAMAccountName rather than DN, so users
+		//moved between OUs are not re-added. Members without a sAMAccountName are still matched by DN
+		MatchByAccountName bool
+		//MatchByObjectID is objectGUID or objectSid to compare users and group members by that attribute rather
+		//than DN, which survives renames as well as moves. Modifies still use the DNs
+		MatchByObjectID string
+		//MemberAttribute is the group attribute holding its members, member (the default) for DNs or
+		//memberUid for the bare usernames of posix groups
+		MemberAttribute string
+		//ResolveNestedGroups treats users in groups nested inside the target group as already present
+		ResolveNestedGroups bool
+		//ChaseReferrals follows referrals returned when resolving members from other domains, and the
+		//references subtree user searches return for other domains, connecting to the referred server with the
+		//same account. Otherwise such members are logged and matched by DN and such users are skipped
+		ChaseReferrals bool
+		//ReferralHops is how many referrals in a row are followed before giving up, defaults to 3
+		ReferralHops int
+		//RemoveStale removes group members that are no longer in the user OU
+		RemoveStale bool
+		//NeverRemove lists members that RemoveStale leaves in every group, matched like ExcludeUsers. Account
+		//names and regular expressions only match members whose account name was resolved
+		NeverRemove []string
+		//VerifyMembership reads each group back after its modifies and reports any add or remove that did not
+		//take effect, for example because of a concurrent edit, as an error
+		VerifyMembership bool
+		//RemoveManagedOnly limits RemoveStale to members that adsync added itself, tracked in StateFile, so
+		//members added by hand are never removed
+		RemoveManagedOnly bool
+		//RemoveAfterDays keeps a stale member in the group until it has been missing from the source for this
+		//many days, tracked in StateFile, so a user moved between OUs for a while is not removed. Zero removes
+		//stale members on the first run that finds them
+		RemoveAfterDays int
+		//MaxChangesPercent aborts a group's sync when its adds and removes exceed this percentage of its
+		//current members, zero disables the check
+		MaxChangesPercent int
+		//MaxChanges aborts a group's sync when its adds and removes exceed this number, zero disables the check
+		MaxChanges int
+		//CreateGroup creates a target group that does not exist yet instead of failing on the first modify.
+		//GroupType is security (the default) or distribution, GroupScope is global (the default), domainLocal
+		//or universal, and GroupDescription is set as the new group's description
+		CreateGroup      bool
+		GroupType        string
+		GroupScope       string
+		GroupDescription string
+		//GroupAttributes sets attributes of every target group such as description, info or managedBy on each
+		//run, so manual edits are reverted. Values are text/template templates that can use {{.Group}},
+		//{{.GroupDN}} and {{.UserDN}}, and a value rendering empty clears the attribute
+		GroupAttributes map[string]string
+		//OUGroups creates and maintains a group per child OU, see OUGroups. The groups are created with
+		//GroupType, GroupScope and GroupDescription whether or not CreateGroup is set
+		OUGroups []OUGroups
 	}
 	Logging struct {
+		//Enabled adds a daily log file in Location alongside the console output
 		Enabled  bool
 		Location string
+		//Console writes info to stdout and errors to stderr, defaults to true
+		Console bool
+		//Format is text (the default) or json, which writes one object per line
+		Format string
+		//Level is error, info (the default) or debug
+		Level string
+		//RetentionDays deletes log files older than this many days at startup, zero keeps them forever
+		RetentionDays int
+	}
+	Source struct {
+		//ActiveDirectory, when its host is set, is a separate directory such as another domain or forest that
+		//the users are read from. The group is still read and modified through the top level activeDirectory
+		ActiveDirectory Connection
+		//ForeignPrincipals adds source users to the group by SID, so AD creates foreign security principals
+		//for users of another forest, and matches those principals back to the users by SID. The SIDs come from
+		//the user search, so pairs with a sourceGroupDN also need a userDN
+		ForeignPrincipals bool
+		//CSVPath replaces the OU search with the distinguished names listed in a CSV file
+		CSVPath string
+		//CSVColumn is the header of the column holding the DNs, defaulting to the first column
+		CSVColumn string
+	}
+	Notify struct {
+		//SMTP is the mail server a summary email is sent through after each run, disabled when Host is empty
+		SMTP struct {
+			Host     string
+			Port     int
+			From     string
+			To       []string
+			Username string
+			Password string
+		}
+		//NotifyOnChangeOnly skips the email for runs with no changes and no errors
+		NotifyOnChangeOnly bool
+	}
+	//AuditFile is a CSV file that every add and remove is appended to
+	AuditFile string
+	//StateFile keeps the time each stale member was first seen for RemoveAfterDays, and the members adsync
+	//added for RemoveManagedOnly, between runs
+	StateFile string
+	//DryRun logs the users that would be added or removed without modifying the group
+	DryRun bool
+	//Force applies changes that exceed MaxChangesPercent or MaxChanges
+	Force bool
+}
+
+//Connection describes how to reach and bind to a directory
+type Connection struct {
+	//Host lists the domain controllers to try in order. A single name, or a comma separated list
+	//from the environment or --host, is accepted as well. Entries may be host:port, which sets the port
+	//of that server in place of Port, or URLs such as ldaps://dc1:636, which set its scheme as well
+	Host     []string
+	Port     int
+	UseTLS   bool
+	StartTLS bool
+	//DiscoverDomain is the DNS domain whose SRV records list the domain controllers to use in place of
+	//Host, trying each in turn until one is reachable
+	DiscoverDomain string
+	//Site is the AD site whose domain controllers are tried before the rest of DiscoverDomain's, to stay
+	//off slow links between sites
+	Site string
+	//TLSSkipVerify disables certificate verification for LDAPS and StartTLS.
+	//This is insecure and should only be used for testing
+	TLSSkipVerify bool
+	//TLSCACertFile is a PEM bundle of CAs trusted in place of the system roots
+	TLSCACertFile string
+	//TLSMinVersion is the oldest TLS version accepted, a string from "1.0" to "1.3", defaulting to 1.2
+	TLSMinVersion string
+	//TLSCertFile and TLSKeyFile are the PEM client certificate and key presented during the TLS handshake,
+	//required for external binds
+	TLSCertFile string
+	TLSKeyFile  string
+	//Timeout in seconds applied to dialing and to every LDAP request, zero leaves requests unbounded
+	Timeout int
+	//ConnectTimeout replaces Timeout for dialing a server, the TLS handshake and the bind. ReadTimeout
+	//replaces it for the response to each later request, such as one page of a search or a modify
+	ConnectTimeout int
+	ReadTimeout    int
+	//OperationTimeout is how many seconds a whole operation may take, zero leaving it unbounded: a paged
+	//search across all of its pages, reading a group's members across all of their ranges, or one modify of
+	//a group's members. Each request within it still gets no more than ReadTimeout
+	OperationTimeout int
+	//PageSize is how many entries each page of a search returns, defaulting to 1000. It must not exceed the
+	//server's limit, MaxPageSize in AD
+	PageSize int
+	//MaxRetries is how many times a failed connection is retried, RetryDelay is the
+	//initial wait in seconds and doubles after each attempt
+	MaxRetries int
+	RetryDelay int
+	Domain     string
+	Username   string
+	Password   string
+	//PasswordFile and PasswordEnv take precedence over Password, in that order
+	PasswordFile string
+	PasswordEnv  string
+	//AuthMethod is simple (the default) for a DOMAIN\user password bind, ntlm for an NTLM password bind,
+	//gssapi for Kerberos, anonymous for an unauthenticated bind or external for SASL EXTERNAL with the TLS
+	//client certificate
+	AuthMethod string
+	//SigningRequired declares that the DCs require LDAP signing. adsync cannot sign plain LDAP, so every
+	//connection must then use TLS, which AD accepts in its place
+	SigningRequired bool
+	//ChannelBindingEnforced declares that the DCs enforce LDAP channel binding. The ntlm and gssapi binds send
+	//no channel binding token, so binds must then be simple or external over TLS
+	ChannelBindingEnforced bool
+	//BindMethod is how simple binds name the account: domain (the default) for Domain\Username, upn for
+	//Username@Domain, or dn for a Username that is the account's full distinguished name
+	BindMethod string
+	//Keytab authenticates Username in Realm for gssapi binds. Without it the credential cache in
+	//KRB5CCNAME or /tmp/krb5cc_<uid> is used
+	Keytab string
+	Realm  string
+	//Krb5Config is the kerberos configuration file, defaulting to /etc/krb5.conf
+	Krb5Config string
+	//ServicePrincipal is the SPN of the directory service, defaulting to ldap/<host>
+	ServicePrincipal string
+
+	//GlobalCatalog searches for users through the Global Catalog of the same hosts, on port 3268 or 3269
+	//with LDAPS, so one search spans every domain of the forest. Groups are still modified over the normal
+	//port. The catalog only holds a partial set of attributes, and those outside it read as empty
+	GlobalCatalog bool
+
+	//tlsConfig is built from the TLS settings at startup when any connection uses TLS
+	tlsConfig *tls.Config
+	//catalog is set on the copy of the settings used for Global Catalog searches
+	catalog bool
+}
+
+//SyncPair maps the users of one OU onto the membership of one group
+type SyncPair struct {
+	UserDN string
+	//UserDNs lists further OUs whose users are unioned with those of UserDN
+	UserDNs []string
+	GroupDN string
+	Group   string
+	//UserFilter replaces activeDirectory.userFilter for this pair, ExtraUserFilter and SkipDisabled still apply
+	UserFilter string
+	//ObjectClasses replaces activeDirectory.objectClasses for this pair, and is overridden by its UserFilter
+	ObjectClasses []string
+	//ExtraUserFilter is ANDed with the user search filter after activeDirectory.extraUserFilter
+	ExtraUserFilter string
+	//IncludeUsers and ExcludeUsers apply on top of the global lists, so a user must pass both include lists
+	//and is left out when either exclude list matches
+	IncludeUsers []string
+	ExcludeUsers []string
+	//NeverRemove lists members of this pair's group kept by RemoveStale, on top of activeDirectory.neverRemove
+	NeverRemove []string
+	//DependsOn names the groups of other mappings that are synchronized before this one, such as a role group
+	//that this group nests
+	DependsOn []string
+	//Scope is base, onelevel or subtree. When empty the pair searches onelevel, or subtree with Recursive set
+	Scope string
+	//ExcludeOUs are child OUs of UserDN whose users are left out of a subtree search
+	ExcludeOUs []string
+	//SourceGroupDN takes the users from the group with this DN, including those of groups nested in it. With
+	//UserDN also set only the members that the user search returns are mirrored, applying its filters
+	SourceGroupDN string
+
+	//rule limits the pair to the users it matches, for pairs built from Rules
+	rule *Rule
+	//create makes the group when it is missing, for pairs built from OUGroups
+	create bool
+}
+
+//Return pairs ordered so every pair comes after the pairs whose groups it DependsOn, otherwise keeping their
+//configured order. A dependency on a group no pair synchronizes, or a cycle, is an error
+func orderPairs(pairs []SyncPair) ([]SyncPair, error) {
+	byGroup := make(map[string][]int)
+	for i, x := range pairs {
+		name := strings.ToLower(x.Group)
+		byGroup[name] = append(byGroup[name], i)
+	}
+
+	//Kahn's algorithm, always taking the earliest ready pair so independent pairs keep their order
+	waiting := make([]int, len(pairs))
+	dependents := make([][]int, len(pairs))
+	for i, x := range pairs {
+		for _, dep := range x.DependsOn {
+			found, ok := byGroup[strings.ToLower(dep)]
+			if !ok {
+				return nil, fmt.Errorf("group %s depends on %s, which no mapping synchronizes", x.Group, dep)
+			}
+			for _, j := range found {
+				if j == i {
+					return nil, fmt.Errorf("group %s depends on itself", x.Group)
+				}
+				waiting[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	ordered := make([]SyncPair, 0, len(pairs))
+	done := make([]bool, len(pairs))
+	for len(ordered) < len(pairs) {
+		next := -1
+		for i := range pairs {
+			if !done[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var cycle []string
+			for i, x := range pairs {
+				if !done[i] {
+					cycle = append(cycle, x.Group)
+				}
+			}
+			return nil, fmt.Errorf("dependsOn forms a cycle between groups %s", strings.Join(cycle, ", "))
+		}
+		done[next] = true
+		ordered = append(ordered, pairs[next])
+		for _, j := range dependents[next] {
+			waiting[j]--
+		}
+	}
+	return ordered, nil
+}
+
+//Return the configured sync pairs, treating the flat UserDN/GroupDN/Group fields as a single pair, followed by
+//a pair per rule. With rules or OUGroups configured the flat fields only form a pair when Group is set. The
+//pairs of OUGroups depend on the directory and come from ouPairs
+func (c *Configuration) syncPairs() []SyncPair {
+	ad := &c.ActiveDirectory
+	var pairs []SyncPair
+	if len(ad.Mappings) > 0 {
+		pairs = append(pairs, ad.Mappings...)
+	} else if (len(ad.Rules) == 0 && len(ad.OUGroups) == 0) || ad.Group != "" {
+		pairs = append(pairs, SyncPair{
+			UserDN:  ad.UserDN,
+			GroupDN: ad.GroupDN,
+			Group:   ad.Group,
+		})
+	}
+
+	for i := range ad.Rules {
+		pairs = append(pairs, SyncPair{
+			UserDN:  ad.UserDN,
+			GroupDN: ad.Rules[i].GroupDN,
+			Group:   ad.Rules[i].Group,
+			rule:    &ad.Rules[i],
+		})
+	}
+	return pairs
+}
+
+//Return the configured member attribute, defaulting to member
+func (c *Configuration) memberAttribute() string {
+	if c.ActiveDirectory.MemberAttribute == "" {
+		return "member"
+	}
+	return c.ActiveDirectory.MemberAttribute
+}
+
+//Return every OU searched for the pair's users
+func (p SyncPair) userDNs() []string {
+	if p.UserDN == "" {
+		return p.UserDNs
+	}
+	return append([]string{p.UserDN}, p.UserDNs...)
+}
+
+//Build the distinguished name of the group, escaping the characters of the name that are special in a DN
+func (p SyncPair) groupDN() string {
+	return fmt.Sprintf("cn=%s,%s", ldap.EscapeDN(p.Group), p.GroupDN)
+}
+
+//Report whether any connection to the directory uses TLS, through UseTLS, StartTLS or an ldaps:// host
+func (ad *Connection) usesTLS() bool {
+	if ad.UseTLS || ad.StartTLS {
+		return true
+	}
+	for _, x := range ad.Host {
+		if _, _, ldaps, err := ad.endpoint(x); err == nil && ldaps {
+			return true
+		}
+	}
+	return false
+}
+
+//Report whether every connection to the directory uses TLS
+func (ad *Connection) allTLS() bool {
+	if ad.StartTLS {
+		return true
+	}
+	if ad.DiscoverDomain != "" {
+		return ad.UseTLS
+	}
+	for _, x := range ad.Host {
+		if _, _, ldaps, err := ad.endpoint(x); err != nil || !ldaps {
+			return false
+		}
+	}
+	return true
+}
+
+//Return the timeout for dialing and binding, zero for none
+func (ad *Connection) connectTimeout() time.Duration {
+	if ad.ConnectTimeout > 0 {
+		return time.Duration(ad.ConnectTimeout) * time.Second
+	}
+	return time.Duration(ad.Timeout) * time.Second
+}
+
+//Return the timeout for each request after the bind, zero for none
+func (ad *Connection) readTimeout() time.Duration {
+	if ad.ReadTimeout > 0 {
+		return time.Duration(ad.ReadTimeout) * time.Second
+	}
+	return time.Duration(ad.Timeout) * time.Second
+}
+
+//Trim the spaces around each Host entry, which a comma separated list keeps, and drop the empty ones
+func (ad *Connection) trimHosts() {
+	var hosts []string
+	for _, x := range ad.Host {
+		if x = strings.TrimSpace(x); x != "" {
+			hosts = append(hosts, x)
+		}
+	}
+	ad.Host = hosts
+}
+
+//Report whether the connection names its servers, through Host or DiscoverDomain
+func (ad *Connection) configured() bool {
+	return len(ad.Host) > 0 || ad.DiscoverDomain != ""
+}
+
+//Return the search page size, 1000 when PageSize is unset
+func (ad *Connection) pageSize() uint32 {
+	if ad.PageSize <= 0 {
+		return 1000
+	}
+	return uint32(ad.PageSize)
+}
+
+//Replace the inline bind password with the one from PasswordFile or PasswordEnv when either is set
+func (ad *Connection) resolvePassword() error {
+	if ad.PasswordFile != "" {
+		b, err := os.ReadFile(ad.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("unable to read password file: %w", err)
+		}
+		ad.Password = strings.TrimRightFunc(string(b), unicode.IsSpace)
+	} else if ad.PasswordEnv != "" {
+		ad.Password = os.Getenv(ad.PasswordEnv)
+	}
+
+	return nil
+}
+
+//Check the host, credentials and TLS settings of the connection, naming each problem under prefix
+func (ad *Connection) validate(prefix string) []string {
+	var problems []string
+
+	if len(ad.Host) == 0 && ad.DiscoverDomain == "" {
+		problems = append(problems, "one of "+prefix+".host or discoverDomain is required")
+	}
+	if ad.Site != "" && ad.DiscoverDomain == "" {
+		problems = append(problems, prefix+".site requires discoverDomain")
+	}
+	switch ad.BindMethod {
+	case "", "domain", "upn":
+	case "dn":
+		if _, err := ldap.ParseDN(ad.Username); err != nil {
+			problems = append(problems, prefix+".username must be a DN with bindMethod dn")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.bindMethod %q is not domain, upn or dn", prefix, ad.BindMethod))
+	}
+	if ad.PageSize < 0 {
+		problems = append(problems, prefix+".pageSize cannot be negative")
+	}
+	if ad.Timeout < 0 || ad.ConnectTimeout < 0 || ad.ReadTimeout < 0 || ad.OperationTimeout < 0 {
+		problems = append(problems, prefix+".timeout, connectTimeout, readTimeout and operationTimeout cannot be negative")
+	}
+	switch ad.AuthMethod {
+	case "", "simple", "ntlm":
+		if ad.Username == "" {
+			problems = append(problems, prefix+".username is required")
+		}
+		if ad.Password == "" && ad.PasswordFile == "" && ad.PasswordEnv == "" {
+			problems = append(problems, "one of "+prefix+".password, passwordFile or passwordEnv is required")
+		}
+	case "gssapi":
+		if ad.Keytab != "" && ad.Username == "" {
+			problems = append(problems, prefix+".username is required when using a keytab")
+		}
+	case "anonymous":
+	case "external":
+		if !ad.usesTLS() {
+			problems = append(problems, prefix+".authMethod external requires useTLS, startTLS or an ldaps:// host")
+		}
+		if ad.TLSCertFile == "" {
+			problems = append(problems, prefix+".tlsCertFile is required for external binds")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.authMethod %q is not simple, ntlm, gssapi, anonymous or external", prefix, ad.AuthMethod))
+	}
+
+	for _, x := range ad.Host {
+		_, _, ldaps, err := ad.endpoint(x)
+		if err != nil {
+			problems = append(problems, prefix+".host: "+err.Error())
+		} else if ldaps && ad.StartTLS {
+			problems = append(problems, fmt.Sprintf("%s.startTLS cannot be used with the LDAPS host %s", prefix, x))
+		}
+	}
+	if (ad.SigningRequired || ad.ChannelBindingEnforced) && !ad.allTLS() {
+		problems = append(problems, prefix+".signingRequired and channelBindingEnforced need useTLS, startTLS or ldaps:// for every host")
+	}
+	if ad.ChannelBindingEnforced && (ad.AuthMethod == "ntlm" || ad.AuthMethod == "gssapi") {
+		problems = append(problems, fmt.Sprintf("%s.authMethod %s cannot be used with channelBindingEnforced, use simple or external", prefix, ad.AuthMethod))
+	}
+	if ad.UseTLS && ad.StartTLS {
+		problems = append(problems, prefix+".useTLS and startTLS are mutually exclusive, enable only one")
+	}
+	if !ad.usesTLS() && (ad.TLSSkipVerify || ad.TLSCACertFile != "" || ad.TLSCertFile != "" || ad.TLSMinVersion != "") {
+		problems = append(problems, prefix+".tlsSkipVerify, tlsCACertFile, tlsCertFile and tlsMinVersion require useTLS, startTLS or an ldaps:// host")
+	}
+	if _, ok := tlsVersions[ad.TLSMinVersion]; !ok {
+		problems = append(problems, fmt.Sprintf("%s.tlsMinVersion %q is not 1.0, 1.1, 1.2 or 1.3", prefix, ad.TLSMinVersion))
+	}
+	if (ad.TLSCertFile == "") != (ad.TLSKeyFile == "") {
+		problems = append(problems, prefix+".tlsCertFile and tlsKeyFile must be set together")
+	}
+	if ad.TLSCACertFile != "" {
+		if _, err := os.Stat(ad.TLSCACertFile); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.tlsCACertFile cannot be read: %v", prefix, err))
+		}
+	}
+
+	return problems
+}
+
+//Check that every required setting is present and that the TLS options are coherent, reporting all problems at once
+func (c *Configuration) Validate() error {
+	ad := c.ActiveDirectory
+	var problems []string
+
+	problems = append(problems, ad.Connection.validate("activeDirectory")...)
+	if c.Source.ActiveDirectory.configured() {
+		problems = append(problems, c.Source.ActiveDirectory.validate("source.activeDirectory")...)
+	}
+	if c.Source.ForeignPrincipals {
+		if !c.Source.ActiveDirectory.configured() || c.Source.CSVPath != "" {
+			problems = append(problems, "source.foreignPrincipals requires source.activeDirectory.host or discoverDomain and no source.csvPath")
+		}
+		if ad.MatchByAccountName || ad.MatchByObjectID != "" || ad.MemberAttribute == "memberUid" {
+			problems = append(problems, "source.foreignPrincipals cannot be used with matchByAccountName, matchByObjectID or memberUid")
+		}
+	}
+
+	pairs := c.syncPairs()
+	for i, x := range pairs {
+		name := "activeDirectory"
+		if rule := i - (len(pairs) - len(ad.Rules)); rule >= 0 {
+			name = fmt.Sprintf("activeDirectory.rules[%d]", rule)
+			switch {
+			case (x.rule.Match == "") == (x.rule.Expression == ""):
+				problems = append(problems, name+" needs exactly one of match or expression")
+			case x.rule.Expression != "":
+				if err := x.rule.compile(); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.expression: %v", name, err))
+				}
+			default:
+				if _, _, ok := x.rule.parse(); !ok {
+					problems = append(problems, fmt.Sprintf("%s.match %q is not of the form attribute=value", name, x.rule.Match))
+				}
+			}
+		} else if len(ad.Mappings) > 0 {
+			name = fmt.Sprintf("activeDirectory.mappings[%d]", i)
+		}
+		if len(x.userDNs()) == 0 && x.SourceGroupDN == "" && c.Source.CSVPath == "" {
+			problems = append(problems, name+".userDN or sourceGroupDN is required")
+		}
+		if x.GroupDN == "" {
+			problems = append(problems, name+".groupDN is required")
+		}
+		if x.Group == "" {
+			problems = append(problems, name+".group is required")
+		}
+		if x.SourceGroupDN != "" && normalizeName(x.SourceGroupDN) == normalizeName(x.groupDN()) {
+			problems = append(problems, name+".sourceGroupDN is the group being synchronized")
+		}
+		if x.UserFilter != "" && !balancedParens(x.UserFilter) {
+			problems = append(problems, name+".userFilter has unbalanced parentheses")
+		}
+		if x.ExtraUserFilter != "" && !balancedParens(x.ExtraUserFilter) {
+			problems = append(problems, name+".extraUserFilter has unbalanced parentheses")
+		}
+		problems = append(problems, checkObjectClasses(name, x.ObjectClasses)...)
+		problems = append(problems, checkUserPatterns(name+".includeUsers", x.IncludeUsers)...)
+		problems = append(problems, checkUserPatterns(name+".excludeUsers", x.ExcludeUsers)...)
+		problems = append(problems, checkUserPatterns(name+".neverRemove", x.NeverRemove)...)
+		switch x.Scope {
+		case "", "base", "onelevel", "subtree":
+		default:
+			problems = append(problems, fmt.Sprintf("%s.scope %q is not base, onelevel or subtree", name, x.Scope))
+		}
+		for _, ou := range x.ExcludeOUs {
+			if _, err := ldap.ParseDN(ou); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.excludeOUs entry %q is not a valid DN", name, ou))
+			}
+		}
+	}
+
+	if ad.UserFilter != "" && !balancedParens(ad.UserFilter) {
+		problems = append(problems, "activeDirectory.userFilter has unbalanced parentheses")
+	}
+	if ad.UserFilter != "" && len(ad.ObjectClasses) > 0 {
+		problems = append(problems, "activeDirectory.userFilter and objectClasses cannot both be set")
+	}
+	problems = append(problems, checkObjectClasses("activeDirectory", ad.ObjectClasses)...)
+	problems = append(problems, checkUserPatterns("activeDirectory.includeUsers", ad.IncludeUsers)...)
+	problems = append(problems, checkUserPatterns("activeDirectory.excludeUsers", ad.ExcludeUsers)...)
+	problems = append(problems, checkUserPatterns("activeDirectory.neverRemove", ad.NeverRemove)...)
+	if ad.ExtraUserFilter != "" && !balancedParens(ad.ExtraUserFilter) {
+		problems = append(problems, "activeDirectory.extraUserFilter has unbalanced parentheses")
+	}
+
+	switch ad.MemberAttribute {
+	case "", "member":
+	case "memberUid":
+		if ad.ResolveNestedGroups || ad.MatchByAccountName || ad.MatchByObjectID != "" {
+			problems = append(problems, "activeDirectory.resolveNestedGroups, matchByAccountName and matchByObjectID cannot be used with memberUid")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("activeDirectory.memberAttribute %q is not member or memberUid", ad.MemberAttribute))
+	}
+
+	switch strings.ToLower(ad.MatchByObjectID) {
+	case "", "objectguid", "objectsid":
+	default:
+		problems = append(problems, fmt.Sprintf("activeDirectory.matchByObjectID %q is not objectGUID or objectSid", ad.MatchByObjectID))
+	}
+	if ad.MatchByObjectID != "" && ad.MatchByAccountName {
+		problems = append(problems, "activeDirectory.matchByObjectID and matchByAccountName cannot both be set")
+	}
+	if ad.MaxChanges < 0 || ad.MaxChangesPercent < 0 {
+		problems = append(problems, "activeDirectory.maxChanges and maxChangesPercent cannot be negative")
+	}
+	if ad.RemoveAfterDays < 0 {
+		problems = append(problems, "activeDirectory.removeAfterDays cannot be negative")
+	}
+	if ad.ChaseReferrals && ad.ReferralHops < 1 {
+		problems = append(problems, "activeDirectory.referralHops must be at least 1")
+	}
+	if (ad.RemoveAfterDays > 0 || ad.RemoveManagedOnly) && c.StateFile == "" {
+		problems = append(problems, "stateFile is required with activeDirectory.removeAfterDays and removeManagedOnly")
+	}
+
+	if _, err := orderPairs(pairs); err != nil {
+		problems = append(problems, "activeDirectory.mappings: "+err.Error())
+	}
+	for i, x := range ad.OUGroups {
+		problems = append(problems, x.validate(fmt.Sprintf("activeDirectory.ouGroups[%d]", i))...)
+	}
+	if len(ad.OUGroups) > 0 && c.Source.CSVPath != "" {
+		problems = append(problems, "activeDirectory.ouGroups cannot be used with source.csvPath")
+	}
+	if ad.CreateGroup || len(ad.OUGroups) > 0 {
+		if ad.MemberAttribute == "memberUid" {
+			problems = append(problems, "activeDirectory.createGroup and ouGroups cannot be used with memberUid")
+		}
+		if _, err := groupType(ad.GroupType, ad.GroupScope); err != nil {
+			problems = append(problems, "activeDirectory."+err.Error())
+		}
+	}
+
+	for name, value := range ad.GroupAttributes {
+		switch strings.ToLower(name) {
+		case "member", "memberuid", "cn", "name", "objectclass", "distinguishedname":
+			problems = append(problems, fmt.Sprintf("activeDirectory.groupAttributes cannot set %s", name))
+			continue
+		}
+		if _, err := template.New(name).Parse(value); err != nil {
+			problems = append(problems, fmt.Sprintf("activeDirectory.groupAttributes.%s: %v", name, err))
+		}
+	}
+
+	if c.Source.CSVPath != "" && len(ad.Rules) > 0 {
+		problems = append(problems, "activeDirectory.rules need user attributes and cannot be used with source.csvPath")
+	}
+	if c.Source.CSVPath != "" {
+		if _, err := readCSVUsers(c.Source.CSVPath, c.Source.CSVColumn); err != nil {
+			problems = append(problems, "source.csvPath: "+err.Error())
+		}
+	}
+
+	if c.Notify.SMTP.Host != "" && (c.Notify.SMTP.From == "" || len(c.Notify.SMTP.To) == 0) {
+		problems = append(problems, "notify.smtp.from and notify.smtp.to are required when notify.smtp.host is set")
+	}
+
+	if _, err := logLevel(); err != nil {
+		problems = append(problems, "logging.level: "+err.Error())
+	}
+	switch c.Logging.Format {
+	case "", "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("logging.format %q is not text or json", c.Logging.Format))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+//Report the entries of classes that are not a known object class, naming the setting with prefix
+func checkObjectClasses(prefix string, classes []string) []string {
+	var problems []string
+	for _, x := range classes {
+		if _, ok := objectClassFilters[strings.ToLower(x)]; !ok {
+			problems = append(problems, fmt.Sprintf("%s.objectClasses entry %q is not user, contact, computer or inetOrgPerson", prefix, x))
+		}
+	}
+	return problems
+}
+
+//Report the /regex/ entries of list that are not valid regular expressions, naming the setting with prefix
+func checkUserPatterns(prefix string, list []string) []string {
+	var problems []string
+	for _, x := range list {
+		if _, err := userPattern(x); err != nil {
+			problems = append(problems, fmt.Sprintf("%s entry %s: %v", prefix, x, err))
+		}
 	}
+	return problems
 }
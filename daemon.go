@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//Synchronize every interval until SIGINT or SIGTERM is received. A failed cycle is logged and the next one
+//still runs, so a transient outage doesn't stop the service. A signal during a cycle cancels it rather than
+//waiting for the reconciliation to finish
+func daemon(interval time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//SIGHUP discards the cached user lists and starts a full cycle straight away
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	writeInfo(fmt.Sprintf("Starting adsync %s in daemon mode, synchronizing every %s", version, interval), logField{"version", version}, logField{"commit", commit})
+	for {
+		//Each cycle logs to the file of its own day and applies RetentionDays, as a fresh run would
+		if err := rotateLog(); err != nil {
+			writeError(err)
+		}
+		pruneLogs()
+
+		if err := syncAll(ctx); err != nil && ctx.Err() == nil {
+			writeError(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-hup:
+			writeInfo("Received SIGHUP, refreshing the user lists")
+			clearUserCache()
+		case <-ctx.Done():
+			writeInfo("Received shutdown signal, shutting down")
+			return nil
+		}
+	}
+}
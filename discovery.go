@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//Return the AD servers to try in order. With DiscoverDomain set they are the domain controllers its
+//_ldap._tcp SRV records list, or the Global Catalog servers of _gc._tcp for catalog searches, ordered by
+//priority and shuffled by weight within each priority. Those of Site come first, so the other sites are
+//only used when none of its DCs is reachable. Otherwise they are the Host entries
+func (ad *Connection) hosts() ([]string, error) {
+	if ad.DiscoverDomain == "" {
+		return ad.Host, nil
+	}
+
+	service := "ldap"
+	if ad.catalog {
+		service = "gc"
+	}
+	var hosts []string
+	if ad.Site != "" {
+		//A site without DCs of its own publishes no records, which leaves the domain wide ones
+		local, err := lookupHosts(service, ad.Site+"._sites."+ad.DiscoverDomain)
+		if err != nil {
+			writeInfo(fmt.Sprintf("No domain controllers found in site %s, using those of the whole domain: %v", ad.Site, err))
+		}
+		hosts = local
+	}
+	all, err := lookupHosts(service, ad.DiscoverDomain)
+	if err != nil && len(hosts) == 0 {
+		return nil, fmt.Errorf("unable to discover the domain controllers of %s: %w", ad.DiscoverDomain, err)
+	}
+	seen := make(map[string]struct{}, len(hosts))
+	for _, x := range hosts {
+		seen[strings.ToLower(x)] = struct{}{}
+	}
+	for _, x := range all {
+		if _, ok := seen[strings.ToLower(x)]; !ok {
+			hosts = append(hosts, x)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no domain controllers are published for %s", ad.DiscoverDomain)
+	}
+	writeDebug(fmt.Sprintf("Discovered %d domain controllers for %s: %s", len(hosts), ad.DiscoverDomain, strings.Join(hosts, ", ")))
+	return hosts, nil
+}
+
+//Return the servers the _service._tcp SRV records of name list, in the order net.LookupSRV sorts them
+func lookupHosts(service, name string) ([]string, error) {
+	_, records, err := net.LookupSRV(service, "tcp", name)
+	if err != nil {
+		return nil, err
+	}
+
+	//The record ports are the plain LDAP ones, so the names are used bare and Port and UseTLS apply as
+	//they do to Host
+	var hosts []string
+	for _, x := range records {
+		if x.Target == "." {
+			continue
+		}
+		hosts = append(hosts, strings.TrimSuffix(x.Target, "."))
+	}
+	return hosts, nil
+}
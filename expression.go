@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//A compiled rule expression. Expressions test user attributes with a small CEL-like syntax:
+//
+//	user.department == "IT" && !user.title.contains("Contractor")
+//
+//user.<attribute> is the attribute's values, empty when it is absent. == and != compare ignoring case and are
+//true when any value matches, as are the contains, startsWith and endsWith methods. has(user.<attribute>)
+//tests that an attribute is present, and &&, ||, ! and parentheses combine the tests
+type expression struct {
+	root  exprNode
+	attrs []string
+}
+
+//The result of evaluating part of an expression, either a boolean or a list of strings
+type exprValue struct {
+	isBool bool
+	b      bool
+	list   []string
+}
+
+type exprNode interface {
+	eval(u directoryUser) (exprValue, error)
+}
+
+//Parse src into an expression, returning the attributes it reads alongside it
+func compileExpression(src string) (*expression, error) {
+	p := &exprParser{src: []rune(src)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", string(p.src[p.pos:]), p.pos)
+	}
+	return &expression{root: root, attrs: p.attrs}, nil
+}
+
+//Evaluate the expression for u, which must give a boolean
+func (e *expression) eval(u directoryUser) (bool, error) {
+	v, err := e.root.eval(u)
+	if err != nil {
+		return false, err
+	}
+	if !v.isBool {
+		return false, fmt.Errorf("expression gives a string, not a boolean")
+	}
+	return v.b, nil
+}
+
+type exprParser struct {
+	src   []rune
+	pos   int
+	attrs []string
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+//Consume tok if it comes next
+func (p *exprParser) accept(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(string(p.src[p.pos:]), tok) {
+		p.pos += len([]rune(tok))
+		return true
+	}
+	return false
+}
+
+//Read an identifier, which for attribute names may include digits, - and _
+func (p *exprParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsLetter(p.src[p.pos]) || unicode.IsDigit(p.src[p.pos]) || p.src[p.pos] == '-' || p.src[p.pos] == '_') {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right exprNode
+		right, err = p.parseAnd()
+		left = &logicNode{and: false, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right exprNode
+		right, err = p.parseUnary()
+		left = &logicNode{and: true, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		return &notNode{operand: operand}, err
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.accept(op) {
+			right, err := p.parsePostfix()
+			return &compareNode{negate: op == "!=", left: left, right: right}, err
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	for err == nil && p.accept(".") {
+		name := p.ident()
+		switch name {
+		case "contains", "startsWith", "endsWith":
+		default:
+			return nil, fmt.Errorf("unknown method %q at offset %d", name, p.pos)
+		}
+		var arg exprNode
+		if !p.accept("(") {
+			return nil, fmt.Errorf("expected ( after %s at offset %d", name, p.pos)
+		}
+		if arg, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ) at offset %d", p.pos)
+		}
+		node = &methodNode{name: name, target: node, arg: arg}
+	}
+	return node, err
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	switch {
+	case p.src[p.pos] == '"':
+		return p.parseString()
+	case p.accept("("):
+		node, err := p.parseOr()
+		if err == nil && !p.accept(")") {
+			err = fmt.Errorf("expected ) at offset %d", p.pos)
+		}
+		return node, err
+	}
+
+	start := p.pos
+	switch name := p.ident(); name {
+	case "true", "false":
+		return &constNode{value: exprValue{isBool: true, b: name == "true"}}, nil
+	case "user":
+		if !p.accept(".") {
+			return nil, fmt.Errorf("expected .attribute after user at offset %d", p.pos)
+		}
+		attr := p.ident()
+		if attr == "" {
+			return nil, fmt.Errorf("expected an attribute name at offset %d", p.pos)
+		}
+		p.attrs = append(p.attrs, attr)
+		return &attrNode{name: strings.ToLower(attr)}, nil
+	case "has":
+		if !p.accept("(") {
+			return nil, fmt.Errorf("expected ( after has at offset %d", p.pos)
+		}
+		arg, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := arg.(*attrNode); !ok {
+			return nil, fmt.Errorf("has takes a user attribute")
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ) at offset %d", p.pos)
+		}
+		return &hasNode{attr: arg.(*attrNode)}, nil
+	case "":
+		return nil, fmt.Errorf("unexpected %q at offset %d", string(p.src[start]), start)
+	default:
+		return nil, fmt.Errorf("unknown name %q at offset %d", name, start)
+	}
+}
+
+//Read a double quoted string, where \" and \\ escape a quote and a backslash
+func (p *exprParser) parseString() (exprNode, error) {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		r := p.src[p.pos]
+		p.pos++
+		switch {
+		case r == '"':
+			return &constNode{value: exprValue{list: []string{b.String()}}}, nil
+		case r == '\\' && p.pos < len(p.src):
+			b.WriteRune(p.src[p.pos])
+			p.pos++
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return nil, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+type constNode struct{ value exprValue }
+
+func (n *constNode) eval(directoryUser) (exprValue, error) { return n.value, nil }
+
+type attrNode struct{ name string }
+
+func (n *attrNode) eval(u directoryUser) (exprValue, error) {
+	return exprValue{list: u.Attributes[n.name]}, nil
+}
+
+type hasNode struct{ attr *attrNode }
+
+func (n *hasNode) eval(u directoryUser) (exprValue, error) {
+	return exprValue{isBool: true, b: len(u.Attributes[n.attr.name]) > 0}, nil
+}
+
+type notNode struct{ operand exprNode }
+
+func (n *notNode) eval(u directoryUser) (exprValue, error) {
+	b, err := evalBool(n.operand, u, "!")
+	return exprValue{isBool: true, b: !b}, err
+}
+
+type logicNode struct {
+	and         bool
+	left, right exprNode
+}
+
+func (n *logicNode) eval(u directoryUser) (exprValue, error) {
+	op := "||"
+	if n.and {
+		op = "&&"
+	}
+	b, err := evalBool(n.left, u, op)
+	if err != nil || b != n.and {
+		return exprValue{isBool: true, b: b}, err
+	}
+	b, err = evalBool(n.right, u, op)
+	return exprValue{isBool: true, b: b}, err
+}
+
+type compareNode struct {
+	negate      bool
+	left, right exprNode
+}
+
+func (n *compareNode) eval(u directoryUser) (exprValue, error) {
+	l, err := n.left.eval(u)
+	if err != nil {
+		return exprValue{}, err
+	}
+	r, err := n.right.eval(u)
+	if err != nil {
+		return exprValue{}, err
+	}
+
+	var equal bool
+	switch {
+	case l.isBool && r.isBool:
+		equal = l.b == r.b
+	case l.isBool || r.isBool:
+		return exprValue{}, fmt.Errorf("cannot compare a boolean with a string")
+	default:
+		equal = anyValue(l.list, func(x string) bool {
+			return anyValue(r.list, func(y string) bool { return strings.EqualFold(x, y) })
+		})
+	}
+	return exprValue{isBool: true, b: equal != n.negate}, nil
+}
+
+type methodNode struct {
+	name        string
+	target, arg exprNode
+}
+
+func (n *methodNode) eval(u directoryUser) (exprValue, error) {
+	t, err := n.target.eval(u)
+	if err != nil {
+		return exprValue{}, err
+	}
+	a, err := n.arg.eval(u)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if t.isBool || a.isBool || len(a.list) != 1 {
+		return exprValue{}, fmt.Errorf("%s needs a string target and a single string argument", n.name)
+	}
+
+	test := map[string]func(string, string) bool{
+		"contains":   strings.Contains,
+		"startsWith": strings.HasPrefix,
+		"endsWith":   strings.HasSuffix,
+	}[n.name]
+	arg := strings.ToUpper(a.list[0])
+	found := anyValue(t.list, func(x string) bool { return test(strings.ToUpper(x), arg) })
+	return exprValue{isBool: true, b: found}, nil
+}
+
+//Evaluate n as the operand of op, which must give a boolean
+func evalBool(n exprNode, u directoryUser, op string) (bool, error) {
+	v, err := n.eval(u)
+	if err != nil {
+		return false, err
+	}
+	if !v.isBool {
+		return false, fmt.Errorf("%s needs a boolean operand, not a string", op)
+	}
+	return v.b, nil
+}
+
+//Report whether test holds for any value in list
+func anyValue(list []string, test func(string) bool) bool {
+	for _, x := range list {
+		if test(x) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+//Report whether the user with the normalized DN dn matches an entry in ExcludeUsers or in the pair's own
+//ExcludeUsers. Entries may be a full DN, a bare CN, a DOMAIN\user style account name, which is compared
+//against the sAMAccountName and CN, or a wildcard pattern such as SVC_* matched against any of them
+func isExcluded(pair SyncPair, dn string) bool {
+	return matchesUser(config.ActiveDirectory.ExcludeUsers, dn) || matchesUser(pair.ExcludeUsers, dn)
+}
+
+//Report whether the user with the normalized DN dn may be added to the pair's group. The global IncludeUsers
+//and the pair's own must both allow it, and an empty list allows every user. Entries are compared the same
+//way as ExcludeUsers
+func isIncluded(pair SyncPair, dn string) bool {
+	for _, list := range [][]string{config.ActiveDirectory.IncludeUsers, pair.IncludeUsers} {
+		if len(list) > 0 && !matchesUser(list, dn) {
+			return false
+		}
+	}
+	return true
+}
+
+//Compiled /regex/ entries of the user lists, keyed by the entry. Validate compiles every entry once, so only
+//valid patterns reach matchesUser
+var userPatterns = make(map[string]*regexp.Regexp)
+
+//Return the regular expression of a /regex/ list entry, or nil when x is not one
+func userPattern(x string) (*regexp.Regexp, error) {
+	if len(x) < 2 || !strings.HasPrefix(x, "/") || !strings.HasSuffix(x, "/") {
+		return nil, nil
+	}
+	if re, ok := userPatterns[x]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile("(?i)" + x[1:len(x)-1])
+	if err != nil {
+		return nil, err
+	}
+	userPatterns[x] = re
+	return re, nil
+}
+
+//Report whether the group member dn is protected from removal by NeverRemove or the pair's own NeverRemove
+func isProtected(pair SyncPair, dn string) bool {
+	return matchesUser(config.ActiveDirectory.NeverRemove, dn) || matchesUser(pair.NeverRemove, dn)
+}
+
+//Report whether dn matches any entry in list by full DN, CN or sAMAccountName, ignoring case. Entries holding
+//* or ? are wildcard patterns, and entries written as /regex/ are regular expressions tested against the
+//sAMAccountName alone
+func matchesUser(list []string, dn string) bool {
+	//memberUid usernames keep their case through normalizeName, so both sides are folded here
+	cn := commonName(dn)
+	account := strings.ToUpper(accountNames[dn])
+	dn = strings.ToUpper(dn)
+	for _, x := range list {
+		if re, _ := userPattern(x); re != nil {
+			if account != "" && re.MatchString(account) {
+				return true
+			}
+			continue
+		}
+		x = strings.ToUpper(normalizeName(x))
+		if i := strings.LastIndex(x, "\\"); i >= 0 && !strings.Contains(x, "=") {
+			x = x[i+1:]
+		}
+		if x == dn || (cn != "" && x == cn) || (account != "" && x == account) {
+			return true
+		}
+		if strings.ContainsAny(x, "*?") && (globMatch(x, dn) || globMatch(x, cn) || globMatch(x, account)) {
+			return true
+		}
+	}
+	return false
+}
+
+//Report whether the non-empty value matches pattern, where * matches any run of characters, commas included,
+//and ? matches exactly one
+func globMatch(pattern, value string) bool {
+	if value == "" {
+		return false
+	}
+
+	//Backtrack to just after the last * whenever the rest of the pattern fails to match
+	p, v := []rune(pattern), []rune(value)
+	pi, vi, star, mark := 0, 0, -1, 0
+	for vi < len(v) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == v[vi]):
+			pi++
+			vi++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, vi
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			vi = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+//Return the value of the leading CN component of dn, or an empty string if it has none
+func commonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+
+	for _, x := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(x.Type, "CN") {
+			return strings.ToUpper(x.Value)
+		}
+	}
+	return ""
+}
+
+//Report whether dn lies anywhere beneath one of the OUs in ous, ignoring case
+func inOU(dn string, ous []string) bool {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+
+	for _, x := range ous {
+		ou, err := ldap.ParseDN(x)
+		if err == nil && ou.AncestorOfFold(parsed) {
+			return true
+		}
+	}
+	return false
+}
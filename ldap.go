@@ -0,0 +1,932 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-ldap/ldap/v3/gssapi"
+)
+
+//The directory operations the sync depends on, so the reconciliation logic does not need a live domain controller
+type directoryClient interface {
+	//ListUsers returns the user objects matching filter within scope of dn, with the values of attrs
+	ListUsers(dn string, scope int, filter string, attrs []string) ([]directoryUser, error)
+	//ListGroupMembers reports whether the group named group exists under dn and returns its raw member values
+	ListGroupMembers(dn, group string) ([]string, bool, error)
+	//AccountName returns the sAMAccountName of the object at dn, or an empty string if it has none
+	AccountName(dn string) (string, error)
+	//ObjectID returns the objectGUID and objectSid of the object at dn, empty when it has none
+	ObjectID(dn string) (guid, sid string, err error)
+	//GroupMembers reports whether the object at dn is a group and if so returns its member values
+	GroupMembers(dn string) ([]string, bool, error)
+	//NestedGroups returns the DNs of the groups in the domain of the group at dn that are its direct members
+	NestedGroups(dn string) ([]string, error)
+	//GroupAttributes returns the values of attrs on the object at dn, joined with "; " when multi valued
+	GroupAttributes(dn string, attrs []string) (map[string]string, error)
+	//ReplaceAttributes overwrites each attribute of the object at dn with its value, clearing those set to ""
+	ReplaceAttributes(dn string, values map[string]string) error
+	//ListOUs returns the DNs of the organizational units directly under dn
+	ListOUs(dn string) ([]string, error)
+	//CreateGroup creates the group named group under dn
+	CreateGroup(dn, group string) error
+	//AddMembers adds every member in a single modify request
+	AddMembers(groupDN string, members []string) error
+	RemoveMember(groupDN, member string) error
+}
+
+//A user returned by a directory search
+type directoryUser struct {
+	DN          string
+	AccountName string
+	//SID is the objectSid in its S-1-5-21-... string form and GUID the objectGUID in its dashed string form,
+	//both empty for directories other than AD
+	SID  string
+	GUID string
+	//PrimaryGroup is the SID of the user's primary group, built from its primaryGroupID and domain
+	PrimaryGroup string
+	//Expires is when the account expires, the zero time for accounts that never do
+	Expires time.Time
+	//Attributes holds the values of any extra attributes requested, keyed by lower case attribute name
+	Attributes map[string][]string
+}
+
+//directoryClient backed by a bound go-ldap connection, plus a connection per server reached through a referral
+//using the same settings
+type ldapClient struct {
+	conn      *ldap.Conn
+	settings  *Connection
+	referrals map[string]*ldap.Conn
+	//referralMu guards referrals, which Close may empty from another goroutine when the run is cancelled
+	referralMu sync.Mutex
+}
+
+func (c *ldapClient) ListUsers(dn string, scope int, filter string, attrs []string) ([]directoryUser, error) {
+	//Retrieve only the sAMAccountName, uid, objectSid, objectGUID, primaryGroupID and accountExpires attributes plus attrs for all user objects in the OU, the DN comes with every entry
+	searhReq := ldap.NewSearchRequest(dn, scope, ldap.NeverDerefAliases, 0, 0, false, filter, append([]string{"sAMAccountName", "uid", "objectSid", "objectGUID", "primaryGroupID", "accountExpires"}, attrs...), nil)
+	writeDebug(fmt.Sprintf("Searching %s with filter %s", dn, searhReq.Filter))
+
+	//AD caps a single search at MaxPageSize entries, 1000 by default, so page through the results to retrieve every user
+	result, err := c.pagedSearch(c.conn, searhReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search error: %w", err)
+	}
+
+	//Subtree searches of a forest root refer the child domains elsewhere, their users are only synchronized
+	//when the references are followed
+	entries := result.Entries
+	if config.ActiveDirectory.ChaseReferrals {
+		more, err := c.searchReferrals(result.Referrals, searhReq, 1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, more...)
+	} else {
+		for _, x := range result.Referrals {
+			writeInfo(fmt.Sprintf("Search of %s returned a referral to %s, its users are skipped", dn, x))
+		}
+	}
+
+	//Directories other than AD have no sAMAccountName, so the posix uid stands in as the account name
+	var users []directoryUser
+	for _, x := range entries {
+		account := x.GetAttributeValue("sAMAccountName")
+		if account == "" {
+			account = x.GetAttributeValue("uid")
+		}
+		user := directoryUser{
+			DN:          x.DN,
+			AccountName: account,
+			SID:         sidString(x.GetRawAttributeValue("objectSid")),
+			GUID:        guidString(x.GetRawAttributeValue("objectGUID")),
+			Expires:     fileTime(x.GetAttributeValue("accountExpires")),
+		}
+		//primaryGroupID is the RID of a group in the user's own domain, whose SID prefixes the user's
+		if rid := x.GetAttributeValue("primaryGroupID"); rid != "" && user.SID != "" {
+			user.PrimaryGroup = user.SID[:strings.LastIndex(user.SID, "-")+1] + rid
+		}
+		if len(attrs) > 0 {
+			user.Attributes = make(map[string][]string, len(attrs))
+			for _, a := range attrs {
+				user.Attributes[strings.ToLower(a)] = x.GetEqualFoldAttributeValues(a)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+//Return when an operation starting now must be finished under OperationTimeout, the zero time without one
+func (c *ldapClient) deadline() time.Time {
+	if c.settings.OperationTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(c.settings.OperationTimeout) * time.Second)
+}
+
+//Give the next request on conn the time left before deadline, or ReadTimeout when that is shorter, so a DC
+//that stops answering fails the operation in time rather than blocking it. It fails once deadline has passed.
+//Operations call it before each of their requests and restore ReadTimeout when they finish. The timeout is
+//per connection, so with Concurrency above 1 a modify may go out under ReadTimeout alone if another finishes
+//between its bound and its send
+func (c *ldapClient) bound(conn *ldap.Conn, deadline time.Time) error {
+	timeout := c.settings.readTimeout()
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("operation did not finish within operationTimeout (%ds)", c.settings.OperationTimeout)
+		}
+		if timeout == 0 || left < timeout {
+			timeout = left
+		}
+	}
+	conn.SetTimeout(timeout)
+	return nil
+}
+
+//Run req on conn a page of PageSize entries at a time and return every entry and reference of every page.
+//With OperationTimeout set the pages share its time, each also asking the DC to finish within the time left,
+//and the search is abandoned once it runs out
+func (c *ldapClient) pagedSearch(conn *ldap.Conn, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	deadline := c.deadline()
+	defer conn.SetTimeout(c.settings.readTimeout())
+	paging := ldap.NewControlPaging(c.settings.pageSize())
+	paged := *req
+	paged.Controls = append(append([]ldap.Control(nil), req.Controls...), paging)
+
+	result := &ldap.SearchResult{}
+	for {
+		if err := c.bound(conn, deadline); err != nil {
+			//A page size of zero tells the DC to drop the rest of the results. Its answer isn't waited for,
+			//since the DC may be the one not answering
+			if len(paging.Cookie) > 0 {
+				paging.PagingSize = 0
+				abandon := paged
+				go conn.Search(&abandon)
+			}
+			return nil, fmt.Errorf("search of %s: %w", req.BaseDN, err)
+		}
+		if !deadline.IsZero() {
+			paged.TimeLimit = int((time.Until(deadline) + time.Second - 1) / time.Second)
+		}
+
+		page, err := conn.Search(&paged)
+		if err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, page.Entries...)
+		result.Referrals = append(result.Referrals, page.Referrals...)
+
+		next, ok := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(next.Cookie) == 0 {
+			return result, nil
+		}
+		paging.SetCookie(next.Cookie)
+	}
+}
+
+//Convert an AD FILETIME, the number of 100ns intervals since 1601-01-01 UTC, to a time. Empty values, 0 and
+//the maximum int64 all mean never and give the zero time
+func fileTime(value string) time.Time {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 || n == math.MaxInt64 {
+		return time.Time{}
+	}
+
+	const epochOffset = 116444736000000000 //100ns intervals between 1601-01-01 and 1970-01-01
+	n -= epochOffset
+	return time.Unix(n/1e7, n%1e7*100)
+}
+
+//Convert a binary objectSid to its S-R-I-S-S... string form, returning an empty string for malformed values.
+//The identifier authority is big endian and the sub authorities little endian
+func sidString(b []byte) string {
+	if len(b) < 8 || len(b) != 8+4*int(b[1]) {
+		return ""
+	}
+
+	var authority uint64
+	for _, x := range b[2:8] {
+		authority = authority<<8 | uint64(x)
+	}
+	sid := fmt.Sprintf("S-%d-%d", b[0], authority)
+	for i := 8; i < len(b); i += 4 {
+		sid += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[i:]))
+	}
+	return sid
+}
+
+//Convert a binary objectGUID to its dashed string form, returning an empty string for malformed values. The
+//first three groups are stored little endian
+func guidString(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+//Return the SID of the foreign security principal at dn, which AD names CN=<SID>,CN=ForeignSecurityPrincipals,
+//or an empty string when dn is not one
+func foreignPrincipalSID(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) < 2 {
+		return ""
+	}
+	container := parsed.RDNs[1].Attributes
+	if len(container) != 1 || !strings.EqualFold(container[0].Value, "ForeignSecurityPrincipals") {
+		return ""
+	}
+	cn := parsed.RDNs[0].Attributes
+	if len(cn) != 1 || !strings.HasPrefix(strings.ToUpper(cn[0].Value), "S-") {
+		return ""
+	}
+	return cn[0].Value
+}
+
+//Return the search scope for the users of pair. Without an explicit Scope only sub OUs are searched when
+//Recursive is set
+func searchScope(pair SyncPair) int {
+	switch pair.Scope {
+	case "base":
+		return ldap.ScopeBaseObject
+	case "onelevel":
+		return ldap.ScopeSingleLevel
+	case "subtree":
+		return ldap.ScopeWholeSubtree
+	}
+	if config.ActiveDirectory.Recursive {
+		return ldap.ScopeWholeSubtree
+	}
+	return ldap.ScopeSingleLevel
+}
+
+//The search filter for each supported ObjectClasses entry. Computers are a subclass of user in AD, so users
+//are narrowed to people
+var objectClassFilters = map[string]string{
+	"user":          "(&(objectCategory=person)(objectClass=user))",
+	"contact":       "(objectClass=contact)",
+	"computer":      "(objectClass=computer)",
+	"inetorgperson": "(objectClass=inetOrgPerson)",
+}
+
+//Build the user search filter for pair from its UserFilter or ObjectClasses, then the global UserFilter or
+//ObjectClasses, or objectClass=user when all are empty, ANDed with both ExtraUserFilters. With SkipDisabled the
+//LDAP_MATCHING_RULE_BIT_AND rule excludes accounts with the ACCOUNTDISABLE (0x2) bit set in userAccountControl
+func userFilter(pair SyncPair) string {
+	ad := config.ActiveDirectory
+	filter := "(objectClass=user)"
+	switch {
+	case pair.UserFilter != "":
+		filter = pair.UserFilter
+	case len(pair.ObjectClasses) > 0:
+		filter = objectClassFilter(pair.ObjectClasses)
+	case ad.UserFilter != "":
+		filter = ad.UserFilter
+	case len(ad.ObjectClasses) > 0:
+		filter = objectClassFilter(ad.ObjectClasses)
+	}
+	if ad.SkipDisabled {
+		filter += "(!(&(objectClass=user)(userAccountControl:1.2.840.113556.1.4.803:=2)))"
+	}
+	filter += ad.ExtraUserFilter + pair.ExtraUserFilter
+	return "(&" + filter + ")"
+}
+
+//Return the filter matching any of classes
+func objectClassFilter(classes []string) string {
+	if len(classes) == 1 {
+		return objectClassFilters[strings.ToLower(classes[0])]
+	}
+	filter := "(|"
+	for _, x := range classes {
+		filter += objectClassFilters[strings.ToLower(x)]
+	}
+	return filter + ")"
+}
+
+//Report whether every opening parenthesis in filter is closed, and none is closed before it is opened.
+//Escaped parentheses in LDAP filters are written as \28 and \29 so they never appear literally
+func balancedParens(filter string) bool {
+	depth := 0
+	for _, r := range filter {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+func (c *ldapClient) ListGroupMembers(dn, group string) ([]string, bool, error) {
+	//Retrieve only the member attribute for the group. memberUid lists belong to posixGroup objects
+	class := "group"
+	if config.memberAttribute() == "memberUid" {
+		class = "posixGroup"
+	}
+	//Parentheses, * and backslashes in the name would otherwise change the filter
+	filter := fmt.Sprintf("(&(objectClass=%s)(cn=%s))", class, ldap.EscapeFilter(group))
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, filter, []string{config.memberAttribute()}, nil)
+	writeDebug(fmt.Sprintf("Searching %s with filter %s", dn, searhReq.Filter))
+
+	deadline := c.deadline()
+	defer c.conn.SetTimeout(c.settings.readTimeout())
+	if err := c.bound(c.conn, deadline); err != nil {
+		return nil, false, err
+	}
+	result, err := c.conn.Search(searhReq)
+	if err != nil {
+		return nil, false, fmt.Errorf("ldap search error: %w", err)
+	}
+
+	//A missing group or a group without a member attribute is treated as having zero members
+	if len(result.Entries) == 0 {
+		return nil, false, nil
+	}
+	if len(result.Entries[0].Attributes) == 0 {
+		writeInfo("Group found but it has no members")
+		return nil, true, nil
+	}
+	members, err := c.allValues(result.Entries[0], config.memberAttribute(), deadline)
+	if err != nil {
+		return nil, true, err
+	}
+	return members, true, nil
+}
+
+//Return every value of attr on entry. AD returns at most MaxValRange values of a large attribute, 1500 by
+//default, under a name such as member;range=0-1499, so the following ranges are requested until one ends in *.
+//The requests share the operation's deadline
+func (c *ldapClient) allValues(entry *ldap.Entry, attr string, deadline time.Time) ([]string, error) {
+	prefix := strings.ToLower(attr) + ";range="
+	var values []string
+	for {
+		var ranged *ldap.EntryAttribute
+		for _, x := range entry.Attributes {
+			if strings.EqualFold(x.Name, attr) {
+				return append(values, x.Values...), nil
+			}
+			if strings.HasPrefix(strings.ToLower(x.Name), prefix) {
+				ranged = x
+			}
+		}
+		if ranged == nil {
+			return values, nil
+		}
+		values = append(values, ranged.Values...)
+
+		end := ranged.Name[strings.LastIndex(ranged.Name, "-")+1:]
+		if end == "*" {
+			return values, nil
+		}
+		last, err := strconv.Atoi(end)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected ranged attribute %s on %s", ranged.Name, entry.DN)
+		}
+
+		next := fmt.Sprintf("%s;range=%d-*", attr, last+1)
+		searhReq := ldap.NewSearchRequest(entry.DN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{next}, nil)
+		writeDebug(fmt.Sprintf("Reading %s of %s", next, entry.DN))
+		if err := c.bound(c.conn, deadline); err != nil {
+			return nil, err
+		}
+		result, err := c.lookup(searhReq)
+		if err != nil {
+			return nil, fmt.Errorf("ldap search error: %w", err)
+		}
+		if len(result.Entries) == 0 {
+			return values, nil
+		}
+		entry = result.Entries[0]
+	}
+}
+
+func (c *ldapClient) GroupAttributes(dn string, attrs []string) (map[string]string, error) {
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", attrs, nil)
+	writeDebug(fmt.Sprintf("Reading %s of %s", strings.Join(attrs, ", "), dn))
+
+	values := make(map[string]string, len(attrs))
+	result, err := c.conn.Search(searhReq)
+	if err != nil {
+		//A group that has yet to be created has no attributes to compare against
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return values, nil
+		}
+		return nil, fmt.Errorf("ldap search error: %w", err)
+	}
+
+	if len(result.Entries) > 0 {
+		for _, a := range attrs {
+			values[a] = strings.Join(result.Entries[0].GetEqualFoldAttributeValues(a), "; ")
+		}
+	}
+	return values, nil
+}
+
+func (c *ldapClient) ReplaceAttributes(dn string, values map[string]string) error {
+	modifyReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	for name, value := range values {
+		if value == "" {
+			modifyReq.Replace(name, []string{})
+		} else {
+			modifyReq.Replace(name, []string{value})
+		}
+	}
+	writeDebug(fmt.Sprintf("Replacing %d attributes of %s", len(values), dn))
+
+	if err := c.conn.Modify(modifyReq); err != nil {
+		return modifyError(err)
+	}
+	return nil
+}
+
+func (c *ldapClient) ListOUs(dn string) ([]string, error) {
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=organizationalUnit)", []string{"ou"}, nil)
+	writeDebug(fmt.Sprintf("Listing the OUs under %s", dn))
+
+	result, err := c.pagedSearch(c.conn, searhReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search error: %w", err)
+	}
+
+	ous := make([]string, len(result.Entries))
+	for i, x := range result.Entries {
+		ous[i] = x.DN
+	}
+	return ous, nil
+}
+
+func (c *ldapClient) CreateGroup(dn, group string) error {
+	ad := config.ActiveDirectory
+	kind, err := groupType(ad.GroupType, ad.GroupScope)
+	if err != nil {
+		return err
+	}
+
+	groupDN := fmt.Sprintf("CN=%s,%s", ldap.EscapeDN(group), dn)
+	addReq := ldap.NewAddRequest(groupDN, []ldap.Control{})
+	addReq.Attribute("objectClass", []string{"top", "group"})
+	addReq.Attribute("cn", []string{group})
+	addReq.Attribute("sAMAccountName", []string{group})
+	addReq.Attribute("groupType", []string{strconv.Itoa(int(kind))})
+	if ad.GroupDescription != "" {
+		addReq.Attribute("description", []string{ad.GroupDescription})
+	}
+	writeDebug(fmt.Sprintf("Creating group %s with groupType %d", groupDN, kind))
+
+	if err := c.conn.Add(addReq); err != nil {
+		return fmt.Errorf("ldap add error: %w", err)
+	}
+	return nil
+}
+
+//Return the AD groupType value for a group of the given type and scope, security and global when empty.
+//Security groups have the high bit set, so the value is negative as AD stores it
+func groupType(kind, scope string) (int32, error) {
+	var value int32
+	switch strings.ToLower(scope) {
+	case "", "global":
+		value = 0x2
+	case "domainlocal":
+		value = 0x4
+	case "universal":
+		value = 0x8
+	default:
+		return 0, fmt.Errorf("groupScope %q is not global, domainLocal or universal", scope)
+	}
+
+	switch strings.ToLower(kind) {
+	case "", "security":
+		value |= math.MinInt32
+	case "distribution":
+	default:
+		return 0, fmt.Errorf("groupType %q is not security or distribution", kind)
+	}
+	return value, nil
+}
+
+func (c *ldapClient) AccountName(dn string) (string, error) {
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"sAMAccountName"}, nil)
+	writeDebug(fmt.Sprintf("Resolving sAMAccountName of %s", dn))
+
+	result, err := c.lookup(searhReq)
+	if err != nil {
+		//The member may live in a partition or domain this account cannot read, fall back to matching by DN
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+			return "", nil
+		}
+		return "", fmt.Errorf("ldap search error: %w", err)
+	}
+
+	if len(result.Entries) == 0 {
+		return "", nil
+	}
+	return result.Entries[0].GetAttributeValue("sAMAccountName"), nil
+}
+
+func (c *ldapClient) ObjectID(dn string) (string, string, error) {
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"objectGUID", "objectSid"}, nil)
+	writeDebug(fmt.Sprintf("Resolving objectGUID and objectSid of %s", dn))
+
+	result, err := c.lookup(searhReq)
+	if err != nil {
+		//As with AccountName, members that can't be read are matched by DN instead
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("ldap search error: %w", err)
+	}
+
+	if len(result.Entries) == 0 {
+		return "", "", nil
+	}
+	x := result.Entries[0]
+	return guidString(x.GetRawAttributeValue("objectGUID")), sidString(x.GetRawAttributeValue("objectSid")), nil
+}
+
+func (c *ldapClient) GroupMembers(dn string) ([]string, bool, error) {
+	searhReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"objectClass", "member"}, nil)
+	writeDebug(fmt.Sprintf("Checking whether %s is a group", dn))
+
+	deadline := c.deadline()
+	defer c.conn.SetTimeout(c.settings.readTimeout())
+	if err := c.bound(c.conn, deadline); err != nil {
+		return nil, false, err
+	}
+	result, err := c.lookup(searhReq)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("ldap search error: %w", err)
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, false, nil
+	}
+	for _, x := range result.Entries[0].GetAttributeValues("objectClass") {
+		if strings.EqualFold(x, "group") {
+			members, err := c.allValues(result.Entries[0], "member", deadline)
+			return members, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (c *ldapClient) NestedGroups(dn string) ([]string, error) {
+	//memberOf is only kept for groups of the member's own domain, which is why the search covers that domain
+	filter := fmt.Sprintf("(&(objectClass=group)(memberOf=%s))", ldap.EscapeFilter(dn))
+	searhReq := ldap.NewSearchRequest(domainDN(dn), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{"1.1"}, nil)
+	writeDebug(fmt.Sprintf("Searching %s with filter %s", searhReq.BaseDN, filter))
+
+	result, err := c.pagedSearch(c.conn, searhReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search error: %w", err)
+	}
+	groups := make([]string, len(result.Entries))
+	for i, x := range result.Entries {
+		groups[i] = x.DN
+	}
+	return groups, nil
+}
+
+//Return the DN of the domain holding dn, made of its trailing DC components, or "" when it has none
+func domainDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return ""
+	}
+
+	i := len(parsed.RDNs)
+	for i > 0 && len(parsed.RDNs[i-1].Attributes) == 1 && strings.EqualFold(parsed.RDNs[i-1].Attributes[0].Type, "DC") {
+		i--
+	}
+	return (&ldap.DN{RDNs: parsed.RDNs[i:]}).String()
+}
+
+func (c *ldapClient) AddMembers(groupDN string, members []string) error {
+	modifyReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
+	modifyReq.Add(config.memberAttribute(), members)
+	writeDebug(fmt.Sprintf("Adding %d members to %s: %s", len(members), groupDN, strings.Join(members, "; ")))
+
+	defer c.conn.SetTimeout(c.settings.readTimeout())
+	if err := c.bound(c.conn, c.deadline()); err != nil {
+		return err
+	}
+	if err := c.conn.Modify(modifyReq); err != nil {
+		return modifyError(err)
+	}
+	return nil
+}
+
+func (c *ldapClient) RemoveMember(groupDN, member string) error {
+	modifyReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
+	modifyReq.Delete(config.memberAttribute(), []string{member})
+	writeDebug(fmt.Sprintf("Removing member %s from %s", member, groupDN))
+
+	defer c.conn.SetTimeout(c.settings.readTimeout())
+	if err := c.bound(c.conn, c.deadline()); err != nil {
+		return err
+	}
+	if err := c.conn.Modify(modifyReq); err != nil {
+		return modifyError(err)
+	}
+	return nil
+}
+
+//Wrap a failed modify, explaining access denials for binds that carry no password
+func modifyError(err error) error {
+	method := config.ActiveDirectory.AuthMethod
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) && (method == "anonymous" || method == "external") {
+		return fmt.Errorf("ldap modify error: the %s bind is not permitted to modify the group: %w", method, err)
+	}
+	return fmt.Errorf("ldap modify error: %w", err)
+}
+
+//Dial the AD server host of ad and bind with its service account. The returned
+//connection is shared by every search and modify in the run
+func connect(ad *Connection, host string) (*ldap.Conn, error) {
+	host, address, ldaps, err := ad.endpoint(host)
+	if err != nil {
+		return nil, err
+	}
+
+	//Verify the certificate against the host actually dialed, which differs per domain controller
+	var tc *tls.Config
+	if ad.tlsConfig != nil {
+		tc = ad.tlsConfig.Clone()
+		tc.ServerName = host
+	}
+
+	//ConnectTimeout bounds the dial and TLS handshake, then StartTLS and the bind. Without one the dial keeps
+	//go-ldap's default limit
+	dialer := &net.Dialer{Timeout: ad.connectTimeout()}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = ldap.DefaultTimeout
+	}
+	var l *ldap.Conn
+	if ldaps {
+		l, err = ldap.DialURL("ldaps://"+address, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tc))
+	} else {
+		l, err = ldap.DialURL("ldap://"+address, ldap.DialWithDialer(dialer))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to AD server %s: %w", host, err)
+	}
+	l.SetTimeout(ad.connectTimeout())
+
+	//Upgrade the plaintext connection before any credentials are sent
+	if ad.StartTLS {
+		if err := l.StartTLS(tc); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("unable to negotiate StartTLS: %w", err)
+		}
+	}
+
+	if err := bind(l, ad, host); err != nil {
+		l.Close()
+		return nil, bindError(err, ldaps || ad.StartTLS)
+	}
+
+	//Bound every later request on the connection, including searches and modifies, so a hung DC fails the
+	//request rather than blocking the run. Zero leaves them unbounded
+	l.SetTimeout(ad.readTimeout())
+
+	return l, nil
+}
+
+//Wrap a failed bind, explaining the rejections of DCs hardened to require LDAP signing or channel binding.
+//AD error 80090346 is its channel binding token failure
+func bindError(err error, encrypted bool) error {
+	switch {
+	case !encrypted && ldap.IsErrorWithCode(err, ldap.LDAPResultStrongAuthRequired):
+		return fmt.Errorf("unable to bind to ldap: the server requires LDAP signing, which adsync provides "+
+			"through TLS, so set useTLS or startTLS or use an ldaps:// host: %w", err)
+	case encrypted && strings.Contains(err.Error(), "80090346"):
+		return fmt.Errorf("unable to bind to ldap: the server enforces channel binding, which only simple and "+
+			"external binds satisfy here, so set channelBindingEnforced and use one of them: %w", err)
+	}
+	return fmt.Errorf("unable to bind to ldap: %w", err)
+}
+
+//Authenticate the connection to host using the AuthMethod of ad
+func bind(l *ldap.Conn, ad *Connection, host string) error {
+	switch ad.AuthMethod {
+	case "", "simple":
+		return l.Bind(ad.bindName(), ad.Password)
+	case "ntlm":
+		//The password never crosses the wire, so this works on DCs that refuse simple binds over plain LDAP
+		return l.NTLMBind(ad.Domain, ad.Username, ad.Password)
+	case "anonymous":
+		return l.UnauthenticatedBind("")
+	case "external":
+		//The identity comes from the client certificate presented during the TLS handshake
+		return l.ExternalBind()
+	case "gssapi":
+		client, err := kerberosClient(ad)
+		if err != nil {
+			return fmt.Errorf("unable to load kerberos credentials: %w", err)
+		}
+		defer client.Close()
+
+		spn := ad.ServicePrincipal
+		if spn == "" {
+			spn = "ldap/" + host
+		}
+		return l.GSSAPIBind(client, spn, "")
+	}
+	return fmt.Errorf("unknown auth method %q", ad.AuthMethod)
+}
+
+//Return the name a simple bind authenticates as, formatted by BindMethod. A upn Username that already
+//holds an @ is used as it is
+func (ad *Connection) bindName() string {
+	switch ad.BindMethod {
+	case "dn":
+		return ad.Username
+	case "upn":
+		if strings.Contains(ad.Username, "@") || ad.Domain == "" {
+			return ad.Username
+		}
+		return ad.Username + "@" + ad.Domain
+	}
+	return ad.Domain + "\\" + ad.Username
+}
+
+//Build a kerberos client from the keytab when one is configured, otherwise from the host's credential cache
+func kerberosClient(ad *Connection) (*gssapi.Client, error) {
+	krb5conf := ad.Krb5Config
+	if krb5conf == "" {
+		krb5conf = "/etc/krb5.conf"
+	}
+
+	if ad.Keytab != "" {
+		return gssapi.NewClientWithKeytab(ad.Username, ad.Realm, ad.Keytab, krb5conf)
+	}
+
+	ccache := os.Getenv("KRB5CCNAME")
+	if ccache == "" {
+		ccache = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+	}
+	return gssapi.NewClientFromCCache(strings.TrimPrefix(ccache, "FILE:"), krb5conf)
+}
+
+//Connect to the first AD server in Host that dials and binds, cycling through the whole list on every attempt.
+//Rounds in which some server failed with a transient network error are retried with exponential backoff, while
+//bind failures such as bad credentials on every server are returned immediately
+func connectWithRetry(ctx context.Context, ad *Connection) (*ldap.Conn, error) {
+	delay := time.Duration(ad.RetryDelay) * time.Second
+	for attempt := 0; ; attempt++ {
+		//Discovery is repeated on each attempt so a retry picks up DCs published since
+		hosts, err := ad.hosts()
+		transient := isTransient(err)
+		for _, host := range hosts {
+			var l *ldap.Conn
+			l, err = connect(ad, host)
+			if err == nil {
+				writeInfo(fmt.Sprintf("Connected to %s", host), logField{"host", host})
+				return l, nil
+			}
+			transient = transient || isTransient(err)
+			writeInfo(fmt.Sprintf("Unable to use AD server %s: %v", host, err), logField{"host", host})
+		}
+		if len(hosts) > 1 {
+			err = fmt.Errorf("none of the %d AD servers could be used, the last failed with: %w", len(hosts), err)
+		}
+		if attempt >= ad.MaxRetries || !transient {
+			return nil, err
+		}
+
+		writeInfo(fmt.Sprintf("Connection attempt %d of %d failed, retrying in %s", attempt+1, ad.MaxRetries+1, delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+//Report whether err is a connection level failure that may succeed on a later attempt
+func isTransient(err error) bool {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		switch ldapErr.ResultCode {
+		case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+//Split a Host entry, either a bare name with an optional port or an ldap:// or ldaps:// URL with an optional
+//port, into the name of the AD server, its host:port address and whether it is dialed with LDAPS. Bare names
+//use UseTLS, and Port unless they carry their own, and the port defaults to 636 for LDAPS and 389 for plain
+//LDAP. Global Catalog connections always use 3269 or 3268
+func (ad *Connection) endpoint(entry string) (string, string, bool, error) {
+	host, port, ldaps := entry, ad.Port, ad.UseTLS
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil {
+			return "", "", false, fmt.Errorf("invalid host %q: %w", entry, err)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "ldap":
+			ldaps = false
+		case "ldaps":
+			ldaps = true
+		default:
+			return "", "", false, fmt.Errorf("invalid host %q, the scheme must be ldap or ldaps", entry)
+		}
+		host, port = u.Hostname(), 0
+		if u.Port() != "" {
+			if port, err = strconv.Atoi(u.Port()); err != nil || port < 1 || port > 65535 {
+				return "", "", false, fmt.Errorf("invalid host %q, the port must be a number from 1 to 65535", entry)
+			}
+		}
+	} else if h, p, err := net.SplitHostPort(entry); err == nil {
+		host = h
+		if port, err = strconv.Atoi(p); err != nil || port < 1 || port > 65535 {
+			return "", "", false, fmt.Errorf("invalid host %q, the port must be a number from 1 to 65535", entry)
+		}
+	} else if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		//A bracketed IPv6 address without a port, which JoinHostPort brackets again
+		host = entry[1 : len(entry)-1]
+	}
+	if host == "" {
+		return "", "", false, fmt.Errorf("invalid host %q, it names no server", entry)
+	}
+
+	switch {
+	case ad.catalog && ldaps:
+		port = 3269
+	case ad.catalog:
+		port = 3268
+	case port == 0 && ldaps:
+		port = 636
+	case port == 0:
+		port = 389
+	}
+	return host, net.JoinHostPort(host, strconv.Itoa(port)), ldaps, nil
+}
+
+//TLS versions accepted by TLSMinVersion. Empty leaves the crypto/tls default of TLS 1.2
+var tlsVersions = map[string]uint16{
+	"":    0,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//Build the TLS settings used for LDAPS and StartTLS, trusting the configured CA bundle and presenting the
+//client certificate if either is given
+func buildTLSConfig(ad *Connection) (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: ad.TLSSkipVerify,
+		MinVersion:         tlsVersions[ad.TLSMinVersion],
+	}
+
+	if ad.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ad.TLSCertFile, ad.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if ad.TLSCACertFile != "" {
+		pem, err := os.ReadFile(ad.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file %s", ad.TLSCACertFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Date layout used in log file names, zero padded so files sort and never collide
+const logDateLayout = "2006-01-02"
+
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+var (
+	logFile *os.File
+	//logDay is the date in the name of logFile
+	logDay      string
+	errorLogger *log.Logger
+	infoLogger  *log.Logger
+	level       = levelInfo
+	logMu       sync.Mutex
+	//consoleOut receives the console info log, stderr for adsync check so its stdout is only the drift
+	consoleOut io.Writer = os.Stdout
+)
+
+//A named value attached to a log entry. Fields are only written out in the json format
+type logField struct {
+	Key   string
+	Value string
+}
+
+//Create the loggers, writing to stdout and stderr unless Console is disabled and to the daily log file when logging is enabled
+func openLog() error {
+	var err error
+	if level, err = logLevel(); err != nil {
+		return err
+	}
+
+	var infoOut, errorOut []io.Writer
+	if config.Logging.Console {
+		infoOut = append(infoOut, consoleOut)
+		errorOut = append(errorOut, os.Stderr)
+	}
+
+	if config.Logging.Enabled {
+		//generate a log file name based on the current date, create the file or append if it already exists
+		logDay = time.Now().Format(logDateLayout)
+		logfilename := "adsync_" + logDay + ".log"
+		logFile, err = os.OpenFile(filepath.Join(config.Logging.Location, logfilename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		infoOut = append(infoOut, logFile)
+		errorOut = append(errorOut, logFile)
+	}
+
+	if len(infoOut) == 0 {
+		return nil
+	}
+
+	switch config.Logging.Format {
+	case "", "text":
+		errorLogger = log.New(io.MultiWriter(errorOut...), "ERROR: ", log.Ldate|log.Ltime)
+		infoLogger = log.New(io.MultiWriter(infoOut...), "INFO: ", log.Ldate|log.Ltime)
+	case "json":
+		errorLogger = log.New(io.MultiWriter(errorOut...), "", 0)
+		infoLogger = log.New(io.MultiWriter(infoOut...), "", 0)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", config.Logging.Format)
+	}
+
+	return nil
+}
+
+//Switch to a new daily log file once the date has changed since the current one was opened, so a daemon
+//that runs for days keeps one file per day. The previous file is closed once the new one is open
+func rotateLog() error {
+	if !config.Logging.Enabled || time.Now().Format(logDateLayout) == logDay {
+		return nil
+	}
+
+	previous := logFile
+	if err := openLog(); err != nil {
+		return err
+	}
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+//Delete log files in the log directory whose date is older than RetentionDays. Files whose names don't
+//carry a parseable date are left alone
+func pruneLogs() {
+	if !config.Logging.Enabled || config.Logging.RetentionDays <= 0 {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.Logging.Location, "adsync*.log"))
+	if err != nil {
+		writeError(fmt.Errorf("unable to list log files: %w", err))
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -config.Logging.RetentionDays)
+	for _, x := range files {
+		date := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(x), "adsync_"), ".log")
+		day, err := time.ParseInLocation(logDateLayout, date, time.Local)
+		if err != nil || !day.Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(x); err != nil {
+			writeError(fmt.Errorf("unable to delete old log file: %w", err))
+			continue
+		}
+		writeInfo(fmt.Sprintf("Deleted log file %s", x))
+	}
+}
+
+//Map the configured level name to its verbosity, with higher values logging more
+func logLevel() (int, error) {
+	switch config.Logging.Level {
+	case "error":
+		return levelError, nil
+	case "", "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected error, info or debug", config.Logging.Level)
+}
+
+func writeInfo(msg string, fields ...logField) {
+	if infoLogger != nil && level >= levelInfo {
+		writeEntry(infoLogger, "info", msg, fields)
+	}
+}
+
+//Log detail such as search filters and DNs, only written at the debug level
+func writeDebug(msg string, fields ...logField) {
+	if infoLogger != nil && level >= levelDebug {
+		writeEntry(infoLogger, "debug", msg, fields)
+	}
+}
+
+//Record an error. Errors raised before the loggers exist, such as an unreadable config file, go straight to stderr
+func writeError(err error, fields ...logField) {
+	if errorLogger != nil {
+		writeEntry(errorLogger, "error", err.Error(), fields)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "adsync:", err)
+}
+
+//Write a single entry to logger in the configured format. Entries are serialized so concurrent
+//workers never interleave lines across the console and file sinks
+func writeEntry(logger *log.Logger, level, msg string, fields []logField) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if config.Logging.Format != "json" {
+		logger.Println(msg)
+		return
+	}
+
+	entry := map[string]string{
+		"timestamp": time.Now().Format(time.RFC3339),
+		"level":     level,
+		"message":   msg,
+	}
+	for _, x := range fields {
+		entry[x.Key] = x.Value
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		logger.Println(msg)
+		return
+	}
+	logger.Println(string(b))
+}
@@ -1,179 +1,1065 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-ldap/ldap"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var (
-	config      Configuration
-	logFile     *os.File
-	errorLogger *log.Logger
-	infoLogger  *log.Logger
-	adUsers     []string
-	groupUsers  []string
+	config     Configuration
+	adUsers    []string
+	groupUsers []string
+	//Users reached through groups nested in the target group, when ResolveNestedGroups is set
+	nestedUsers []string
+	stats       summary
+	//sAMAccountName of each known user, keyed by normalized DN
+	accountNames map[string]string
+	//<GUID=...> or <SID=...> of each known user when MatchByObjectID is set, keyed by normalized DN
+	objectIDs map[string]string
+	//Users whose primary group is the target group. AD leaves them out of its member attribute, so they count
+	//as present but are never added or removed
+	primaryUsers []string
+	//SID of the primary group of each known user, keyed by normalized name
+	primaryGroups map[string]string
+)
+
+//Build information, set at build time with
+//-ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%F)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
 )
 
 func main() {
-	viper.SetConfigName("config")
-	viper.SetConfigType("json")
-	viper.AddConfigPath(".")
+	if err := run(); err != nil {
+		writeError(err)
+		if errors.Is(err, errDrift) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+//Load the configuration and synchronize every configured group, returning the first error encountered
+func run() error {
+	configFile := pflag.String("config", "", "path to the config file, the format is detected from its extension")
+	configType := pflag.String("config-type", "", "format of the config file (json, yaml or toml), overriding detection")
+	pflag.Bool("dry-run", false, "report the changes that would be made without modifying the group")
+	pflag.Bool("force", false, "apply the changes even when they exceed maxChanges or maxChangesPercent")
+	pflag.String("host", "", "AD servers to connect to, comma separated and tried in order")
+	pflag.String("domain", "", "domain of the bind account")
+	pflag.String("username", "", "bind account username")
+	pflag.String("group", "", "name of the group to synchronize")
+	pflag.String("group-dn", "", "DN of the container holding the group")
+	pflag.String("user-dn", "", "DN of the OU holding the users")
+	verbose := pflag.BoolP("verbose", "v", false, "log at debug level, including LDAP filters and DNs")
+	quiet := pflag.BoolP("quiet", "q", false, "log only errors and the run summary")
+	interval := pflag.Duration("interval", 0, "run continuously, synchronizing every interval (e.g. 5m) until interrupted")
+	metricsAddr := pflag.String("metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9100)")
+	showVersion := pflag.Bool("version", false, "print the version and exit")
+	pflag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: adsync [flags] [plan [planfile] | apply planfile | check]")
+		pflag.PrintDefaults()
+	}
+	pflag.Parse()
+
+	if *showVersion {
+		fmt.Printf("adsync %s (commit %s, built %s)\n", version, commit, date)
+		return nil
+	}
+
+	//plan writes the changes a sync would make to a file, which apply later makes exactly as written. check
+	//prints them and exits with status 2 when there are any
+	command, planFile := pflag.Arg(0), pflag.Arg(1)
+	switch command {
+	case "":
+	case "check":
+		consoleOut = os.Stderr
+	case "plan":
+		if planFile == "" {
+			planFile = "adsync-plan.json"
+		}
+	case "apply":
+		if planFile == "" {
+			return fmt.Errorf("apply needs the plan file to apply")
+		}
+	default:
+		return fmt.Errorf("unknown command %q, expected plan, apply or check", command)
+	}
+	if command != "" && *interval > 0 {
+		return fmt.Errorf("--interval cannot be used with %s", command)
+	}
+
+	//Flags win over environment variables such as ADSYNC_ACTIVEDIRECTORY_HOST, which win over the config file
+	flagKeys := map[string]string{
+		"dry-run":  "dryrun",
+		"force":    "force",
+		"host":     "activedirectory.host",
+		"domain":   "activedirectory.domain",
+		"username": "activedirectory.username",
+		"group":    "activedirectory.group",
+		"group-dn": "activedirectory.groupdn",
+		"user-dn":  "activedirectory.userdn",
+	}
+	for name, key := range flagKeys {
+		viper.BindPFlag(key, pflag.Lookup(name))
+	}
+	viper.SetEnvPrefix("adsync")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	//Without an explicit path look for config.json, config.yaml, config.toml etc. in the current directory, then
+	//in the directory holding the binary so schedulers starting it from elsewhere still find its config
+	if *configFile != "" {
+		viper.SetConfigFile(*configFile)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(".")
+		if exe, err := os.Executable(); err == nil {
+			viper.AddConfigPath(filepath.Dir(exe))
+		}
+	}
+	if *configType != "" {
+		viper.SetConfigType(*configType)
+	}
 
 	viper.SetDefault("logging.enabled", false)
+	viper.SetDefault("logging.console", true)
 	viper.SetDefault("logging.location", ".")
+	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("activedirectory.host", "127.0.0.1")
+	viper.SetDefault("activedirectory.retrydelay", 5)
+	viper.SetDefault("source.activedirectory.retrydelay", 5)
+	viper.SetDefault("activedirectory.batchsize", 500)
+	viper.SetDefault("activedirectory.concurrency", 1)
+	viper.SetDefault("activedirectory.referralhops", 3)
+	viper.SetDefault("statefile", "adsync-state.json")
 
 	err := viper.ReadInConfig()
 	if err != nil {
-		panic(fmt.Errorf("unable to read config file: %w", err))
+		return fmt.Errorf("unable to read config file: %w", err)
 	}
 
 	err = viper.Unmarshal(&config)
 	if err != nil {
-		panic(fmt.Errorf("config file is corrupt: %w", err))
+		return fmt.Errorf("config file is corrupt: %w", err)
+	}
+
+	config.ActiveDirectory.trimHosts()
+	config.Source.ActiveDirectory.trimHosts()
+
+	if *verbose {
+		config.Logging.Level = "debug"
+	} else if *quiet {
+		config.Logging.Level = "error"
+	}
+
+	if err := config.Validate(); err != nil {
+		return err
 	}
 
-	if config.Logging.Enabled {
-		//generate a log file name based on the current date, create the file or append if it already exists
-		now := time.Now()
-		logfilename := "adsync" + strconv.Itoa(now.Year()) + strconv.Itoa(int(now.Month())) + strconv.Itoa(now.Day()) + ".log"
-		logFile, err = os.OpenFile(filepath.Join(config.Logging.Location, logfilename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	connections := []*Connection{&config.ActiveDirectory.Connection}
+	if config.Source.ActiveDirectory.configured() {
+		connections = append(connections, &config.Source.ActiveDirectory)
+	}
+	for _, x := range connections {
+		if err := x.resolvePassword(); err != nil {
+			return err
+		}
+		if x.usesTLS() {
+			x.tlsConfig, err = buildTLSConfig(x)
+			if err != nil {
+				return fmt.Errorf("invalid TLS configuration: %w", err)
+			}
+		}
+	}
+
+	if err := openLog(); err != nil {
+		return err
+	}
+	pruneLogs()
+
+	//check is a monitoring probe run every few minutes, so it leaves no rows in the audit trail
+	if command != "check" {
+		if err := openAudit(); err != nil {
+			return err
+		}
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+
+	switch {
+	case command == "plan":
+		return writePlan(context.Background(), planFile)
+	case command == "apply":
+		return applyPlan(context.Background(), planFile)
+	case command == "check":
+		return checkDrift(context.Background())
+	case *interval > 0:
+		return daemon(*interval)
+	}
+	return syncAll(context.Background())
+}
+
+//Connect to AD, and to the source directory when one is configured, and synchronize every configured pair,
+//reporting a summary of the run at the end. Cancelling ctx closes the connections, aborting any search or
+//modify in flight
+func syncAll(ctx context.Context) (err error) {
+	stats = summary{start: time.Now()}
+	accountNames = make(map[string]string)
+	objectIDs = make(map[string]string)
+	primaryGroups = make(map[string]string)
+	defer func() {
+		stats.Errors += errorCount(err)
+		stats.report()
+		metrics.recordRun(&stats)
+		if !probing() {
+			sendNotification(&stats)
+		}
+	}()
+
+	if err := loadState(); err != nil {
+		return err
+	}
+	defer func() {
+		if serr := saveState(); serr != nil {
+			err = joinErrors([]error{err, serr})
+		}
+	}()
+
+	l, err := connectWithRetry(ctx, &config.ActiveDirectory.Connection)
+	if err != nil {
+		return err
+	}
+	dc := &ldapClient{conn: l, settings: &config.ActiveDirectory.Connection}
+	defer dc.Close()
+
+	//Users are read from the target directory unless a separate source directory is configured, or through
+	//the target's Global Catalog when it has GlobalCatalog set. The catalog is read only, so groups are
+	//always modified over the normal connection
+	src := dc
+	if source := searchConnection(); source != nil {
+		sl, err := connectWithRetry(ctx, source)
 		if err != nil {
-			panic(fmt.Errorf("failed to open log file: %w", err))
+			return fmt.Errorf("source directory: %w", err)
 		}
-		errorLogger = log.New(logFile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-		infoLogger = log.New(logFile, "INFO: ", log.Ldate|log.Ltime)
+		src = &ldapClient{conn: sl, settings: source}
+		defer src.Close()
 	}
 
-	writeInfo("Loading the list of users from Active Directory")
-	listADUsers()
-	writeInfo("Loading the list of users in group")
-	listGroupUsers()
-	writeInfo("Synchronizing group membership")
-	synchronizeGroup()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			dc.Close()
+			src.Close()
+		case <-done:
+		}
+	}()
+
+	if config.DryRun {
+		writeInfo("Dry run enabled, the group will not be modified")
+	}
+
+	//A failing pair is logged and counted but does not stop the remaining pairs from being synchronized
+	var errs []error
+	//Validate has already rejected unknown dependencies and cycles
+	pairs, _ := orderPairs(config.syncPairs())
+	if len(config.ActiveDirectory.OUGroups) > 0 {
+		generated, err := ouPairs(src)
+		if err != nil {
+			writeError(err)
+			errs = append(errs, err)
+		}
+		pairs = append(pairs, generated...)
+	}
+	for _, pair := range pairs {
+		if ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("sync stopped before group %s: %w", pair.Group, ctx.Err()))
+			break
+		}
+
+		err := syncPair(ctx, dc, src, pair)
+		if err == nil {
+			continue
+		}
+		writeError(fmt.Errorf("unable to synchronize group %s: %w", pair.Group, err))
+		if activePlan != nil {
+			activePlan.drop(pair)
+		}
+
+		var pairErrs syncErrors
+		if !errors.As(err, &pairErrs) {
+			pairErrs = syncErrors{err}
+		}
+		for _, x := range pairErrs {
+			errs = append(errs, fmt.Errorf("group %s: %w", pair.Group, x))
+		}
+	}
+
+	return joinErrors(errs)
 }
 
-func writeInfo(msg string) {
-	if infoLogger != nil {
-		infoLogger.Println(msg)
+//Return the settings of the connection users are searched through when it differs from the target's, or nil
+func searchConnection() *Connection {
+	var source Connection
+	switch {
+	case config.Source.ActiveDirectory.configured():
+		source = config.Source.ActiveDirectory
+	case config.ActiveDirectory.GlobalCatalog:
+		source = config.ActiveDirectory.Connection
+	default:
+		return nil
 	}
+	source.catalog = source.GlobalCatalog
+	return &source
 }
 
-func writeError(err error) {
-	if errorLogger != nil {
-		errorLogger.Panic(err)
+//Synchronize the membership of one group in dc with the users of its OU, which are read from src
+func syncPair(ctx context.Context, dc, src directoryClient, pair SyncPair) error {
+	adUsers, groupUsers, nestedUsers, primaryUsers = nil, nil, nil, nil
+
+	switch {
+	case config.Source.CSVPath != "":
+		writeInfo(fmt.Sprintf("Loading the list of users from %s", config.Source.CSVPath))
+	case pair.SourceGroupDN != "":
+		writeInfo(fmt.Sprintf("Loading the list of users in source group %s", pair.SourceGroupDN))
+	default:
+		writeInfo(fmt.Sprintf("Loading the list of users from Active Directory in %s", strings.Join(pair.userDNs(), "; ")))
+	}
+	if err := listADUsers(ctx, src, pair); err != nil {
+		return err
+	}
+	writeInfo(fmt.Sprintf("Loading the list of users in group %s", pair.Group))
+	if err := listGroupUsers(ctx, dc, pair); err != nil {
+		return err
+	}
+	writeInfo("Synchronizing group membership")
+	added, removed := stats.Added, stats.Removed
+	if err := synchronizeGroup(ctx, dc, pair); err != nil {
+		return err
+	}
+	if err := syncGroupAttributes(dc, pair); err != nil {
+		return err
+	}
+
+	size := len(groupUsers)
+	if !config.DryRun {
+		size += stats.Added - added - (stats.Removed - removed)
 	}
-	panic(err)
+	metrics.setGroupSize(pair.Group, size)
+
+	return nil
 }
 
-//Populate the adUsers slice with a list of usernames
-func listADUsers() {
-	l, err := ldap.DialURL(fmt.Sprintf("ldap://%s:389", config.ActiveDirectory.Host))
+//Populate the adUsers slice with a list of usernames, read from the OU, from the pair's SourceGroupDN or from
+//Source.CSVPath when one is set
+func listADUsers(ctx context.Context, dc directoryClient, pair SyncPair) error {
+	var users []directoryUser
+	var err error
+	switch {
+	case config.Source.CSVPath != "":
+		users, err = readCSVUsers(config.Source.CSVPath, config.Source.CSVColumn)
+	case pair.SourceGroupDN != "" && len(pair.userDNs()) > 0:
+		users, err = mirrorSourceGroup(ctx, dc, pair)
+	case pair.SourceGroupDN != "":
+		users, err = listSourceGroup(ctx, dc, pair.SourceGroupDN)
+	default:
+		users, err = searchUsers(dc, pair)
+	}
 	if err != nil {
-		writeError(fmt.Errorf("unable to connect to AD server: %w", err))
+		return err
+	}
+	//An empty source usually means a broken search, except for the groups of ouGroups, whose OU may simply
+	//have emptied. Those are still created and kept in step, with the change limits as the safety net
+	if len(users) == 0 && !pair.create {
+		return fmt.Errorf("no users returned from the source")
+	}
+
+	//Pairs built from rules take only the users the rule matches. A user the rule cannot be evaluated for is
+	//reported and left out without stopping the others
+	if pair.rule != nil {
+		var matched []directoryUser
+		for _, x := range users {
+			ok, err := pair.rule.matches(x)
+			if err != nil {
+				stats.Errors++
+				writeError(fmt.Errorf("unable to evaluate rule %s for %s: %w", pair.rule, x.DN, err))
+				continue
+			}
+			if ok {
+				matched = append(matched, x)
+			}
+		}
+		writeInfo(fmt.Sprintf("%d of %d users match rule %s", len(matched), len(users), pair.rule))
+		users = matched
+	}
+
+	//Accounts count as expired only once they are past accountExpires by more than ExpiredSkew, so a DC whose
+	//clock runs behind doesn't see a user drop out and return
+	if config.ActiveDirectory.ExcludeExpired {
+		cutoff := time.Now().Add(-time.Duration(config.ActiveDirectory.ExpiredSkew) * time.Second)
+		var active []directoryUser
+		for _, x := range users {
+			if !x.Expires.IsZero() && x.Expires.Before(cutoff) {
+				writeDebug(fmt.Sprintf("Skipping %s, it expired at %s", x.DN, x.Expires.Format(time.RFC3339)))
+				continue
+			}
+			active = append(active, x)
+		}
+		writeInfo(fmt.Sprintf("%d expired accounts skipped", len(users)-len(active)))
+		users = active
 	}
-	defer l.Close()
 
-	username := config.ActiveDirectory.Domain + "\\" + config.ActiveDirectory.Username
+	if len(pair.ExcludeOUs) > 0 {
+		var kept []directoryUser
+		for _, x := range users {
+			if inOU(x.DN, pair.ExcludeOUs) {
+				writeDebug(fmt.Sprintf("Skipping %s, it is in an excluded OU", x.DN))
+				continue
+			}
+			kept = append(kept, x)
+		}
+		writeInfo(fmt.Sprintf("%d users in excluded OUs skipped", len(users)-len(kept)))
+		users = kept
+	}
+
+	//memberUid groups hold bare usernames, so users are identified by account name. Values read from a CSV
+	//file are taken as usernames as they are
+	byAccount := config.memberAttribute() == "memberUid" && config.Source.CSVPath == ""
 
-	if err := l.Bind(username, config.ActiveDirectory.Password); err != nil {
-		writeError(fmt.Errorf("unable to bind to ldap: %w", err))
+	seen := make(map[string]struct{}, len(users))
+	for _, x := range users {
+		name := normalizeName(x.DN)
+		switch {
+		case config.Source.ForeignPrincipals:
+			if x.SID == "" {
+				writeDebug(fmt.Sprintf("Skipping %s, it has no objectSid", x.DN))
+				continue
+			}
+			name = principalName(x.SID)
+		case byAccount:
+			if x.AccountName == "" {
+				writeDebug(fmt.Sprintf("Skipping %s, it has no account name", x.DN))
+				continue
+			}
+			name = normalizeName(x.AccountName)
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		adUsers = append(adUsers, name)
+		if x.AccountName != "" {
+			accountNames[name] = normalizeName(x.AccountName)
+		}
+		if id := objectIDKey(x); id != "" {
+			objectIDs[name] = id
+		}
+		if x.PrimaryGroup != "" {
+			primaryGroups[name] = x.PrimaryGroup
+		}
 	}
 
-	//Retrieve only the distinguishedName attribute for all user objects in the OU. Don't go into sub OUs
-	searhReq := ldap.NewSearchRequest(config.ActiveDirectory.UserDN, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(&(objectClass=user))", []string{"distinguishedName"}, nil)
+	stats.ADUsers += len(adUsers)
+	writeInfo(strconv.Itoa(len(adUsers)) + " records retrieved in total")
+	return nil
+}
 
-	result, err := l.Search(searhReq)
+//Populate the groupUsers slice with a list of usernames
+func listGroupUsers(ctx context.Context, dc directoryClient, pair SyncPair) error {
+	members, found, err := dc.ListGroupMembers(pair.GroupDN, pair.Group)
 	if err != nil {
-		writeError(fmt.Errorf("ldap search error: %w", err))
+		return err
+	}
+	switch {
+	case found:
+	case !config.ActiveDirectory.CreateGroup && !pair.create:
+		writeInfo("Group not found, treating it as empty")
+	case config.DryRun:
+		writeInfo(fmt.Sprintf("Group not found, it would be created in %s", pair.GroupDN))
+		if activePlan != nil {
+			activePlan.group(pair).Create = true
+		}
+	default:
+		if err := dc.CreateGroup(pair.GroupDN, pair.Group); err != nil {
+			return fmt.Errorf("unable to create group: %w", err)
+		}
+		writeInfo(fmt.Sprintf("Group not found, created it in %s", pair.GroupDN))
 	}
 
-	if len(result.Entries) > 0 {
-		for _, x := range result.Entries {
-			adUsers = append(adUsers, strings.ToUpper(x.Attributes[0].Values[0]))
+	seen := make(map[string]struct{}, len(members))
+	for _, x := range members {
+		name := memberName(x)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		groupUsers = append(groupUsers, name)
+	}
+
+	//Members that are themselves groups are replaced by the users they contain. Those users count as present
+	//but are never removed, since they aren't direct members
+	if config.ActiveDirectory.ResolveNestedGroups {
+		visited := map[string]struct{}{normalizeName(pair.groupDN()): {}}
+		for _, x := range groupUsers {
+			visited[x] = struct{}{}
+		}
+		direct, groups, err := splitMembers(ctx, dc, pair.groupDN(), groupUsers)
+		if err != nil {
+			return err
+		}
+		for _, x := range groups {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			nested, isGroup, err := dc.GroupMembers(x)
+			if err != nil {
+				return err
+			}
+			if !isGroup {
+				direct = append(direct, x)
+				continue
+			}
+
+			users, err := flattenGroup(ctx, dc, x, nested, visited)
+			if err != nil {
+				return err
+			}
+			writeDebug(fmt.Sprintf("Nested group %s contributes %d users", x, len(users)))
+			nestedUsers = append(nestedUsers, users...)
+		}
+		groupUsers = direct
+		writeInfo(strconv.Itoa(len(nestedUsers)) + " users in nested groups")
+	}
+
+	//Resolve members that weren't part of the user search so an account moved to another OU still matches
+	if config.ActiveDirectory.MatchByAccountName {
+		for _, x := range append(groupUsers, nestedUsers...) {
+			if _, ok := accountNames[x]; ok {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			account, err := dc.AccountName(x)
+			if err != nil {
+				return err
+			}
+			if account != "" {
+				accountNames[x] = normalizeName(account)
+			}
+		}
+	}
+	if config.ActiveDirectory.MatchByObjectID != "" {
+		for _, x := range append(groupUsers, nestedUsers...) {
+			if _, ok := objectIDs[x]; ok {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			guid, sid, err := dc.ObjectID(x)
+			if err != nil {
+				return err
+			}
+			if id := objectIDKey(directoryUser{GUID: guid, SID: sid}); id != "" {
+				objectIDs[x] = id
+			}
 		}
-	} else {
-		writeError(fmt.Errorf("no results returned from ldap search"))
 	}
 
-	writeInfo(strconv.Itoa(len(adUsers)) + " records retrieved")
+	//Adding a user to its own primary group fails, so those users are taken as members already
+	if found && len(primaryGroups) > 0 && config.memberAttribute() == "member" {
+		_, sid, err := dc.ObjectID(pair.groupDN())
+		if err != nil {
+			return err
+		}
+		for _, x := range adUsers {
+			if sid != "" && strings.EqualFold(primaryGroups[x], sid) {
+				primaryUsers = append(primaryUsers, x)
+			}
+		}
+		if len(primaryUsers) > 0 {
+			writeInfo(strconv.Itoa(len(primaryUsers)) + " users have the group as their primary group")
+		}
+	}
+
+	stats.GroupMembers += len(groupUsers)
+	writeInfo(strconv.Itoa(len(groupUsers)) + " users in group")
+	return nil
 }
 
-//Populate the groupUsers slice with a list of usernames
-func listGroupUsers() {
-	l, err := ldap.DialURL(fmt.Sprintf("ldap://%s:389", config.ActiveDirectory.Host))
+//Return the users of the group at dn, expanding the groups nested in it. Account names are resolved when
+//members are matched or stored by them, since the group only holds DNs
+func listSourceGroup(ctx context.Context, dc directoryClient, dn string) ([]directoryUser, error) {
+	members, isGroup, err := dc.GroupMembers(dn)
 	if err != nil {
-		writeError(fmt.Errorf("unable to connect to AD server: %w", err))
+		return nil, err
+	}
+	if !isGroup {
+		return nil, fmt.Errorf("source group %s not found", dn)
 	}
-	defer l.Close()
 
-	username := config.ActiveDirectory.Domain + "\\" + config.ActiveDirectory.Username
+	dns, err := flattenGroup(ctx, dc, dn, members, map[string]struct{}{normalizeName(dn): {}})
+	if err != nil {
+		return nil, err
+	}
 
-	if err := l.Bind(username, config.ActiveDirectory.Password); err != nil {
-		writeError(fmt.Errorf("unable to bind to ldap: %w", err))
+	users := make([]directoryUser, len(dns))
+	for i, x := range dns {
+		users[i].DN = x
+		if config.ActiveDirectory.MatchByAccountName || config.memberAttribute() == "memberUid" {
+			if users[i].AccountName, err = dc.AccountName(x); err != nil {
+				return nil, err
+			}
+		}
+		if config.ActiveDirectory.MatchByObjectID != "" {
+			if users[i].GUID, users[i].SID, err = dc.ObjectID(x); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return users, nil
+}
+
+//Return the users of the pair's source group that the user search of its OUs also returns, so its filter,
+//SkipDisabled and the expiry and rule checks all apply to the mirrored membership
+func mirrorSourceGroup(ctx context.Context, dc directoryClient, pair SyncPair) ([]directoryUser, error) {
+	members, err := listSourceGroup(ctx, dc, pair.SourceGroupDN)
+	if err != nil {
+		return nil, err
+	}
+	searched, err := searchUsers(dc, pair)
+	if err != nil {
+		return nil, err
+	}
+
+	inGroup := make(map[string]struct{}, len(members))
+	for _, x := range members {
+		inGroup[normalizeName(x.DN)] = struct{}{}
+	}
+	var users []directoryUser
+	for _, x := range searched {
+		if _, ok := inGroup[normalizeName(x.DN)]; ok {
+			users = append(users, x)
+		}
+	}
+	writeInfo(fmt.Sprintf("%d of %d source group members pass the user search", len(users), len(members)))
+	return users, nil
+}
 
-	//Retrieve only the member attribute for the group
-	searhReq := ldap.NewSearchRequest(config.ActiveDirectory.GroupDN, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, fmt.Sprintf("(&(objectClass=group)(cn=%s))", config.ActiveDirectory.Group), []string{"member"}, nil)
+//Search every OU of the pair and return the union of their users. Users found in more than one are
+//collapsed when adUsers is built
+func searchUsers(dc directoryClient, pair SyncPair) ([]directoryUser, error) {
+	var users []directoryUser
+	for _, dn := range pair.userDNs() {
+		found, err := cachedListUsers(dc, dn, searchScope(pair), userFilter(pair), config.ruleAttributes())
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, found...)
+	}
+	return users, nil
+}
 
-	result, err := l.Search(searhReq)
+//Expand the member values of the nested group at dn into the users it contains, descending into further
+//groups. visited holds every DN already expanded so membership cycles terminate
+func flattenGroup(ctx context.Context, dc directoryClient, dn string, members []string, visited map[string]struct{}) ([]string, error) {
+	var fresh []string
+	for _, x := range members {
+		name := normalizeName(x)
+		if _, ok := visited[name]; ok {
+			continue
+		}
+		visited[name] = struct{}{}
+		fresh = append(fresh, name)
+	}
+	users, groups, err := splitMembers(ctx, dc, dn, fresh)
 	if err != nil {
-		writeError(fmt.Errorf("ldap search error: %w", err))
+		return nil, err
+	}
+
+	for _, x := range groups {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		nested, isGroup, err := dc.GroupMembers(x)
+		if err != nil {
+			return nil, err
+		}
+		if !isGroup {
+			users = append(users, x)
+			continue
+		}
+
+		sub, err := flattenGroup(ctx, dc, x, nested, visited)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, sub...)
 	}
+	return users, nil
+}
 
-	for _, x := range result.Entries[0].Attributes[0].Values {
-		groupUsers = append(groupUsers, strings.ToUpper(x))
+//Split the normalized members of the group at dn into users and the groups nested in it. One memberOf search
+//finds the groups among the members from the group's own domain, so only members from other domains, whose
+//memberOf doesn't list the group, are looked up one at a time
+func splitMembers(ctx context.Context, dc directoryClient, dn string, members []string) ([]string, []string, error) {
+	domain := normalizeName(domainDN(dn))
+	local := make(map[string]struct{})
+	if domain != "" && len(members) > 0 {
+		groups, err := dc.NestedGroups(dn)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, x := range groups {
+			local[normalizeName(x)] = struct{}{}
+		}
 	}
 
-	writeInfo(strconv.Itoa(len(groupUsers)) + " users in group")
+	var users, groups []string
+	for _, x := range members {
+		if _, ok := local[x]; ok {
+			groups = append(groups, x)
+			continue
+		}
+		if domain != "" && normalizeName(domainDN(x)) == domain {
+			users = append(users, x)
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		_, isGroup, err := dc.GroupMembers(x)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isGroup {
+			groups = append(groups, x)
+		} else {
+			users = append(users, x)
+		}
+	}
+	return users, groups, nil
 }
 
-//Look for users that aren't a member of the group
-func synchronizeGroup() {
+//Look for users that aren't a member of the group, and when RemoveStale is set, members that are no longer in the OU
+func synchronizeGroup(ctx context.Context, dc directoryClient, pair SyncPair) error {
+	//Only users passing the global and pair IncludeUsers and ExcludeUsers are added, with the exclusion winning
+	//when both match
+	members := keySet(append(append(groupUsers, nestedUsers...), primaryUsers...))
+	var missing []string
+	eligible := 0
 	for _, x := range adUsers {
-		found := false
-		for _, y := range groupUsers {
-			if x == y {
-				found = true
-				break
+		if !isIncluded(pair, x) {
+			continue
+		}
+		_, isMember := members[matchKey(x)]
+		if isExcluded(pair, x) {
+			if !isMember {
+				writeInfo(fmt.Sprintf("%s is excluded, skipping", x), logField{"user", x})
 			}
+			continue
 		}
+		eligible++
+		if !isMember {
+			missing = append(missing, x)
+		}
+	}
+	ad := config.ActiveDirectory
+	if len(ad.IncludeUsers) > 0 || len(ad.ExcludeUsers) > 0 || len(pair.IncludeUsers) > 0 || len(pair.ExcludeUsers) > 0 {
+		writeInfo(fmt.Sprintf("%d of %d users remain after filtering", eligible, len(adUsers)))
+	}
 
-		if !found {
-			addUserToGroup(x)
+	var stale []string
+	if config.ActiveDirectory.RemoveStale {
+		users := keySet(adUsers)
+		for _, x := range groupUsers {
+			if _, ok := users[matchKey(x)]; ok {
+				continue
+			}
+			if isProtected(pair, x) {
+				writeInfo(fmt.Sprintf("%s is not in the source but is protected by neverRemove, skipping its removal", x), logField{"user", x})
+				continue
+			}
+			stale = append(stale, x)
 		}
+		stale = pastGracePeriod(pair, managedOnly(pair, stale))
+	}
+
+	if err := checkChangeLimit(pair, len(missing)+len(stale)); err != nil {
+		return err
+	}
+	if activePlan != nil {
+		planned := activePlan.group(pair)
+		planned.Add = append(planned.Add, missing...)
+		planned.Remove = append(planned.Remove, stale...)
 	}
+
+	//Failed modifies are collected rather than returned so one bad account doesn't block everyone after it
+	var errs []error
+
+	if config.DryRun {
+		for _, x := range missing {
+			writeInfo(fmt.Sprintf("%s would be added to group", x), logField{"user", x}, logField{"group", pair.Group})
+			recordChange("add", x, pair.Group, "dry-run")
+		}
+		stats.Added += len(missing)
+		writeInfo(strconv.Itoa(len(missing)) + " users would be added to group")
+	} else {
+		added, err := addUsersToGroup(ctx, dc, pair, missing)
+		stats.Added += added
+		errs = append(errs, err)
+		writeInfo(fmt.Sprintf("%d users added to group, %d failed", added, errorCount(err)))
+	}
+
+	if config.ActiveDirectory.RemoveStale && config.DryRun {
+		for _, x := range stale {
+			writeInfo(fmt.Sprintf("%s would be removed from group", x), logField{"user", x}, logField{"group", pair.Group})
+			recordChange("remove", x, pair.Group, "dry-run")
+		}
+		stats.Removed += len(stale)
+		writeInfo(strconv.Itoa(len(stale)) + " users would be removed from group")
+	} else if config.ActiveDirectory.RemoveStale {
+		removed, err := removeUsersFromGroup(ctx, dc, pair, stale)
+		stats.Removed += removed
+		errs = append(errs, err)
+		writeInfo(fmt.Sprintf("%d users removed from group, %d failed", removed, errorCount(err)))
+	}
+
+	if config.ActiveDirectory.VerifyMembership && !config.DryRun && len(missing)+len(stale) > 0 {
+		errs = append(errs, verifyGroup(dc, pair, missing, stale))
+	}
+	return joinErrors(errs)
 }
 
-//Add a user to the group
-func addUserToGroup(name string) {
-	l, err := ldap.DialURL(fmt.Sprintf("ldap://%s:389", config.ActiveDirectory.Host))
-	if err != nil {
-		writeError(fmt.Errorf("unable to connect to AD server: %w", err))
+//Refuse to apply more than MaxChanges changes, or more than MaxChangesPercent of the group's current size,
+//which usually means the user search came back wrong. The percentage doesn't apply to empty groups. Dry runs
+//and --force are exempt, though a dry run still warns
+func checkChangeLimit(pair SyncPair, changes int) error {
+	ad := config.ActiveDirectory
+	size := len(groupUsers)
+	var msg string
+	switch {
+	case ad.MaxChanges > 0 && changes > ad.MaxChanges:
+		msg = fmt.Sprintf("%d changes to group %s exceed maxChanges (%d)", changes, pair.Group, ad.MaxChanges)
+	case ad.MaxChangesPercent > 0 && size > 0 && changes*100 > ad.MaxChangesPercent*size:
+		msg = fmt.Sprintf("%d changes to group %s exceed maxChangesPercent (%d%% of %d members)", changes, pair.Group, ad.MaxChangesPercent, size)
+	default:
+		return nil
+	}
+
+	if config.Force {
+		writeInfo(msg + ", applying them because --force is set")
+		return nil
+	}
+	if config.DryRun && (activePlan == nil || !activePlan.strict) {
+		writeInfo(msg + ", a real run would abort")
+		return nil
+	}
+	return fmt.Errorf("%s, no changes made. Check the user search or rerun with --force", msg)
+}
+
+//Canonicalize a username so the same account always compares equal. DNs are parsed and rebuilt so spacing
+//between RDNs and the case of attribute names don't matter. DNs and AD account names are case-insensitive,
+//but posix usernames in memberUid are not and keep their case
+func normalizeName(name string) string {
+	name = strings.TrimSpace(name)
+	if config.memberAttribute() == "memberUid" {
+		return name
+	}
+
+	if strings.Contains(name, "=") {
+		if dn, err := ldap.ParseDN(name); err == nil && len(dn.RDNs) > 0 {
+			name = dn.String()
+		}
+	}
+	return strings.ToUpper(name)
+}
+
+//Normalize a raw member value of the target group. With ForeignPrincipals a foreign security principal is
+//named by its SID, the way source users are
+func memberName(member string) string {
+	if sid := foreignPrincipalSID(member); sid != "" && config.Source.ForeignPrincipals {
+		return principalName(sid)
+	}
+	return normalizeName(member)
+}
+
+//Return the <SID=...> form of sid, which AD accepts wherever a DN is expected. Adding a user of another forest
+//to a group by it makes AD create the foreign security principal that stands in for the user
+func principalName(sid string) string {
+	return "<SID=" + strings.ToUpper(sid) + ">"
+}
+
+//Return the <GUID=...> or <SID=...> form of the attribute of u named by MatchByObjectID, or an empty string
+//when it is not set or u has no such value
+func objectIDKey(u directoryUser) string {
+	switch strings.ToLower(config.ActiveDirectory.MatchByObjectID) {
+	case "objectguid":
+		if u.GUID != "" {
+			return "<GUID=" + strings.ToUpper(u.GUID) + ">"
+		}
+	case "objectsid":
+		if u.SID != "" {
+			return principalName(u.SID)
+		}
+	}
+	return ""
+}
+
+//Return the value used to compare the user at dn, which is its object ID when MatchByObjectID is set or its
+//sAMAccountName when MatchByAccountName is set and the value is known, otherwise the DN itself
+func matchKey(dn string) string {
+	if id, ok := objectIDs[dn]; ok {
+		return id
+	}
+	if config.ActiveDirectory.MatchByAccountName {
+		if account, ok := accountNames[dn]; ok {
+			return account
+		}
+	}
+	return dn
+}
+
+//Build a set of the match keys of list for constant time membership checks
+func keySet(list []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(list))
+	for _, x := range list {
+		set[matchKey(x)] = struct{}{}
+	}
+	return set
+}
+
+//Add users to the group in batches of BatchSize members per modify request, running up to Concurrency
+//batches at once. The number added is returned alongside any failures
+func addUsersToGroup(ctx context.Context, dc directoryClient, pair SyncPair, names []string) (int, error) {
+	size := config.ActiveDirectory.BatchSize
+	if size < 1 {
+		size = 1
+	}
+
+	var mu sync.Mutex
+	added := 0
+	var jobs []func() error
+	for len(names) > 0 {
+		n := size
+		if n > len(names) {
+			n = len(names)
+		}
+		batch := names[:n]
+		names = names[n:]
+
+		jobs = append(jobs, func() error {
+			n, err := addBatch(ctx, dc, pair, batch)
+			mu.Lock()
+			added += n
+			mu.Unlock()
+			return err
+		})
+	}
+
+	err := joinErrors(runPool(ctx, config.ActiveDirectory.Concurrency, jobs))
+	return added, err
+}
+
+//Add one batch of users in a single modify request. AD applies a modify atomically, so when the batch is
+//rejected its users are retried one at a time to find the bad entry
+func addBatch(ctx context.Context, dc directoryClient, pair SyncPair, batch []string) (int, error) {
+	err := dc.AddMembers(pair.groupDN(), batch)
+	if err == nil {
+		for _, x := range batch {
+			writeInfo(fmt.Sprintf("%s added to group %s", x, pair.Group), logField{"user", x}, logField{"group", pair.Group})
+			recordChange("add", x, pair.Group, "success")
+			markManaged(pair, x, true)
+		}
+		return len(batch), nil
+	}
+	if len(batch) == 1 {
+		recordChange("add", batch[0], pair.Group, "failed")
+		return 0, fmt.Errorf("unable to add %s: %w", batch[0], err)
+	}
+
+	//A user that is rejected on its own is reported and skipped so the rest of the batch still goes in
+	writeInfo(fmt.Sprintf("Batch of %d users rejected, adding them individually: %v", len(batch), err))
+	added := 0
+	var errs []error
+	for _, x := range batch {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := addUserToGroup(dc, pair, x); err != nil {
+			errs = append(errs, fmt.Errorf("unable to add %s: %w", x, err))
+			continue
+		}
+		added++
+	}
+	return added, joinErrors(errs)
+}
+
+//Remove users from the group, running up to Concurrency modify requests at once
+func removeUsersFromGroup(ctx context.Context, dc directoryClient, pair SyncPair, names []string) (int, error) {
+	var mu sync.Mutex
+	removed := 0
+	jobs := make([]func() error, len(names))
+	for i, x := range names {
+		name := x
+		jobs[i] = func() error {
+			if err := removeUserFromGroup(dc, pair, name); err != nil {
+				return fmt.Errorf("unable to remove %s: %w", name, err)
+			}
+			mu.Lock()
+			removed++
+			mu.Unlock()
+			return nil
+		}
 	}
-	defer l.Close()
 
-	username := config.ActiveDirectory.Domain + "\\" + config.ActiveDirectory.Username
+	err := joinErrors(runPool(ctx, config.ActiveDirectory.Concurrency, jobs))
+	return removed, err
+}
 
-	if err := l.Bind(username, config.ActiveDirectory.Password); err != nil {
-		writeError(fmt.Errorf("unable to bind to ldap: %w", err))
+//Add a user to the group
+func addUserToGroup(dc directoryClient, pair SyncPair, name string) error {
+	if err := dc.AddMembers(pair.groupDN(), []string{name}); err != nil {
+		recordChange("add", name, pair.Group, "failed")
+		return err
 	}
+	recordChange("add", name, pair.Group, "success")
+	markManaged(pair, name, true)
 
-	//Add user to group
-	modifyReq := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", config.ActiveDirectory.Group, config.ActiveDirectory.GroupDN), []ldap.Control{})
-	modifyReq.Add("member", []string{name})
+	writeInfo(fmt.Sprintf("%s added to group %s", name, pair.Group), logField{"user", name}, logField{"group", pair.Group})
+	return nil
+}
 
-	if err := l.Modify(modifyReq); err != nil {
-		writeError(fmt.Errorf("ldap modify error: %w", err))
+//Remove a user from the group
+func removeUserFromGroup(dc directoryClient, pair SyncPair, name string) error {
+	if err := dc.RemoveMember(pair.groupDN(), name); err != nil {
+		recordChange("remove", name, pair.Group, "failed")
+		return err
 	}
+	recordChange("remove", name, pair.Group, "success")
+	markManaged(pair, name, false)
 
-	writeInfo(fmt.Sprintf("%s added to group", name))
+	writeInfo(fmt.Sprintf("%s removed from group %s", name, pair.Group), logField{"user", name}, logField{"group", pair.Group})
+	return nil
 }
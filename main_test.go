@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//directoryClient holding one group in memory, recording every modify made to it
+type fakeDirectory struct {
+	mu      sync.Mutex
+	users   []directoryUser
+	members []string
+	//missing makes the group not exist until CreateGroup is called
+	missing bool
+	//groups holds the member values of the other groups, keyed by normalized DN, and lookups each DN
+	//GroupMembers was asked about
+	groups  map[string][]string
+	lookups []string
+	//rejectBatches fails every modify adding more than one member, reject fails those adding the listed members
+	rejectBatches bool
+	reject        map[string]bool
+	//adds holds the members of each AddMembers call and removes each member passed to RemoveMember
+	adds    [][]string
+	removes []string
+}
+
+func (f *fakeDirectory) ListUsers(dn string, scope int, filter string, attrs []string) ([]directoryUser, error) {
+	return f.users, nil
+}
+
+func (f *fakeDirectory) ListGroupMembers(dn, group string) ([]string, bool, error) {
+	return f.members, !f.missing, nil
+}
+
+func (f *fakeDirectory) AccountName(dn string) (string, error) {
+	return "", nil
+}
+
+func (f *fakeDirectory) ObjectID(dn string) (string, string, error) {
+	return "", "", nil
+}
+
+func (f *fakeDirectory) GroupMembers(dn string) ([]string, bool, error) {
+	f.lookups = append(f.lookups, dn)
+	members, ok := f.groups[normalizeName(dn)]
+	return members, ok, nil
+}
+
+func (f *fakeDirectory) NestedGroups(dn string) ([]string, error) {
+	members, ok := f.groups[normalizeName(dn)]
+	if !ok {
+		members = f.members
+	}
+	var nested []string
+	for _, x := range members {
+		if _, ok := f.groups[normalizeName(x)]; ok {
+			nested = append(nested, x)
+		}
+	}
+	return nested, nil
+}
+
+func (f *fakeDirectory) GroupAttributes(dn string, attrs []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeDirectory) ReplaceAttributes(dn string, values map[string]string) error {
+	return nil
+}
+
+func (f *fakeDirectory) ListOUs(dn string) ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeDirectory) CreateGroup(dn, group string) error {
+	f.missing = false
+	return nil
+}
+
+func (f *fakeDirectory) AddMembers(groupDN string, members []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.adds = append(f.adds, append([]string(nil), members...))
+	if f.rejectBatches && len(members) > 1 {
+		return errors.New("batch rejected")
+	}
+	for _, x := range members {
+		if f.reject[x] {
+			return errors.New("member rejected")
+		}
+	}
+	f.members = append(f.members, members...)
+	return nil
+}
+
+func (f *fakeDirectory) RemoveMember(groupDN, member string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removes = append(f.removes, member)
+	return nil
+}
+
+//The pair every test syncs
+var testPair = SyncPair{UserDN: "OU=Staff,DC=example,DC=com", GroupDN: "OU=Groups,DC=example,DC=com", Group: "Staff"}
+
+//Reset the configuration and the state of the previous sync
+func resetSync(t *testing.T) {
+	t.Helper()
+	config = Configuration{}
+	config.ActiveDirectory.BatchSize = 500
+	config.ActiveDirectory.Concurrency = 1
+	stats = summary{start: time.Now()}
+	accountNames = make(map[string]string)
+	objectIDs = make(map[string]string)
+	primaryGroups = make(map[string]string)
+	activePlan = nil
+	clearUserCache()
+}
+
+//Return a user of the Staff OU with the account name name
+func testUser(name string) directoryUser {
+	return directoryUser{DN: "CN=" + name + ",OU=Staff,DC=example,DC=com", AccountName: name}
+}
+
+//Return the normalized DN a member of the Staff OU is added and removed by
+func testMember(name string) string {
+	return normalizeName("CN=" + name + ",OU=Staff,DC=example,DC=com")
+}
+
+//Return the members of every AddMembers call in one sorted list
+func allAdds(f *fakeDirectory) []string {
+	var added []string
+	for _, x := range f.adds {
+		added = append(added, x...)
+	}
+	sort.Strings(added)
+	return added
+}
+
+func TestSyncPairAddsMissingUsers(t *testing.T) {
+	resetSync(t)
+	dc := &fakeDirectory{
+		users:   []directoryUser{testUser("alice"), testUser("bob"), testUser("carol")},
+		members: []string{"CN=alice,OU=Staff,DC=example,DC=com"},
+	}
+
+	if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{testMember("bob"), testMember("carol")}}
+	if !reflect.DeepEqual(dc.adds, want) {
+		t.Errorf("adds = %v, want %v in one modify", dc.adds, want)
+	}
+	if len(dc.removes) != 0 {
+		t.Errorf("removes = %v, want none", dc.removes)
+	}
+	if stats.Added != 2 {
+		t.Errorf("stats.Added = %d, want 2", stats.Added)
+	}
+}
+
+func TestSyncPairRemovesStaleMembers(t *testing.T) {
+	for _, removeStale := range []bool{false, true} {
+		resetSync(t)
+		config.ActiveDirectory.RemoveStale = removeStale
+		dc := &fakeDirectory{
+			users:   []directoryUser{testUser("alice")},
+			members: []string{"CN=alice,OU=Staff,DC=example,DC=com", "CN=dave,OU=Staff,DC=example,DC=com"},
+		}
+
+		if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if removeStale {
+			want = []string{testMember("dave")}
+		}
+		if !reflect.DeepEqual(dc.removes, want) {
+			t.Errorf("removeStale %v: removes = %v, want %v", removeStale, dc.removes, want)
+		}
+		if len(dc.adds) != 0 {
+			t.Errorf("removeStale %v: adds = %v, want none", removeStale, dc.adds)
+		}
+	}
+}
+
+func TestSyncPairSkipsExcludedUsers(t *testing.T) {
+	resetSync(t)
+	config.ActiveDirectory.ExcludeUsers = []string{"bob", "CN=carol,OU=Staff,DC=example,DC=com"}
+	dc := &fakeDirectory{users: []directoryUser{testUser("alice"), testUser("bob"), testUser("carol")}}
+
+	if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := allAdds(dc), []string{testMember("alice")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added %v, want %v", got, want)
+	}
+}
+
+func TestSyncPairExcludesPosixUsersIgnoringCase(t *testing.T) {
+	resetSync(t)
+	config.ActiveDirectory.MemberAttribute = "memberUid"
+	config.ActiveDirectory.ExcludeUsers = []string{"Bob"}
+	dc := &fakeDirectory{users: []directoryUser{testUser("alice"), testUser("bob")}}
+
+	if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := allAdds(dc), []string{"alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added %v, want %v", got, want)
+	}
+}
+
+func TestSyncPairDryRunChangesNothing(t *testing.T) {
+	resetSync(t)
+	config.DryRun = true
+	config.ActiveDirectory.RemoveStale = true
+	dc := &fakeDirectory{
+		users:   []directoryUser{testUser("alice"), testUser("bob")},
+		members: []string{"CN=alice,OU=Staff,DC=example,DC=com", "CN=dave,OU=Staff,DC=example,DC=com"},
+	}
+
+	if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.adds) != 0 || len(dc.removes) != 0 {
+		t.Errorf("dry run modified the group: adds %v, removes %v", dc.adds, dc.removes)
+	}
+	if stats.Added != 1 || stats.Removed != 1 {
+		t.Errorf("stats.Added, stats.Removed = %d, %d, want 1, 1", stats.Added, stats.Removed)
+	}
+}
+
+func TestSyncPairLooksUpOnlyNestedGroups(t *testing.T) {
+	resetSync(t)
+	config.ActiveDirectory.ResolveNestedGroups = true
+	config.ActiveDirectory.RemoveStale = true
+	team := "CN=Team,OU=Groups,DC=example,DC=com"
+	dc := &fakeDirectory{
+		users:   []directoryUser{testUser("alice"), testUser("bob")},
+		members: []string{"CN=alice,OU=Staff,DC=example,DC=com", team},
+		groups:  map[string][]string{normalizeName(team): {"CN=bob,OU=Staff,DC=example,DC=com"}},
+	}
+
+	if err := syncPair(context.Background(), dc, dc, testPair); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{normalizeName(team)}; !reflect.DeepEqual(dc.lookups, want) {
+		t.Errorf("looked up %v, want only the nested group %v", dc.lookups, want)
+	}
+	if len(dc.adds) != 0 || len(dc.removes) != 0 {
+		t.Errorf("adds %v, removes %v, want none as bob is a member through Team", dc.adds, dc.removes)
+	}
+}
+
+func TestSyncPairEmptiesOUGroup(t *testing.T) {
+	resetSync(t)
+	config.ActiveDirectory.RemoveStale = true
+	config.Force = true
+	pair := testPair
+	pair.create = true
+	dc := &fakeDirectory{members: []string{"CN=alice,OU=Staff,DC=example,DC=com"}}
+
+	if err := syncPair(context.Background(), dc, dc, pair); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{testMember("alice")}; !reflect.DeepEqual(dc.removes, want) {
+		t.Errorf("removes = %v, want %v", dc.removes, want)
+	}
+
+	//A pair without an OU group behind it still refuses an empty source
+	resetSync(t)
+	if err := syncPair(context.Background(), dc, dc, testPair); err == nil {
+		t.Error("syncPair accepted an empty source for a configured pair")
+	}
+}
+
+func TestSyncPairCreatesGroupForEmptyOU(t *testing.T) {
+	resetSync(t)
+	pair := testPair
+	pair.create = true
+	dc := &fakeDirectory{missing: true}
+
+	if err := syncPair(context.Background(), dc, dc, pair); err != nil {
+		t.Fatal(err)
+	}
+	if dc.missing {
+		t.Error("the group of the empty OU was not created")
+	}
+}
+
+func TestAddBatchFallsBackToSingleAdds(t *testing.T) {
+	resetSync(t)
+	dc := &fakeDirectory{rejectBatches: true, reject: map[string]bool{testMember("bad"): true}}
+	names := []string{testMember("alice"), testMember("bad"), testMember("bob")}
+
+	added, err := addBatch(context.Background(), dc, testPair, names)
+	if added != 2 {
+		t.Errorf("added = %d, want 2", added)
+	}
+	if errorCount(err) != 1 {
+		t.Errorf("err = %v, want the one rejected member", err)
+	}
+	want := [][]string{names, {names[0]}, {names[1]}, {names[2]}}
+	if !reflect.DeepEqual(dc.adds, want) {
+		t.Errorf("adds = %v, want the batch then each member alone", dc.adds)
+	}
+	if got, want := dc.members, []string{names[0], names[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+}
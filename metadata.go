@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//The values available to GroupAttributes templates
+type groupTemplateData struct {
+	Group   string
+	GroupDN string
+	UserDN  string
+}
+
+//Render the GroupAttributes templates for pair. The templates were parsed once already by Validate
+func groupAttributeValues(pair SyncPair) (map[string]string, error) {
+	data := groupTemplateData{Group: pair.Group, GroupDN: pair.groupDN(), UserDN: strings.Join(pair.userDNs(), "; ")}
+
+	values := make(map[string]string, len(config.ActiveDirectory.GroupAttributes))
+	for name, text := range config.ActiveDirectory.GroupAttributes {
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("groupAttributes.%s: %w", name, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("groupAttributes.%s: %w", name, err)
+		}
+		values[name] = strings.TrimSpace(b.String())
+	}
+	return values, nil
+}
+
+//Set the GroupAttributes of the pair's group, replacing only the attributes whose value has drifted
+func syncGroupAttributes(dc directoryClient, pair SyncPair) error {
+	if len(config.ActiveDirectory.GroupAttributes) == 0 {
+		return nil
+	}
+
+	want, err := groupAttributeValues(pair)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	have, err := dc.GroupAttributes(pair.groupDN(), names)
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]string)
+	for _, name := range names {
+		if have[name] == want[name] {
+			continue
+		}
+		changed[name] = want[name]
+		if config.DryRun {
+			writeInfo(fmt.Sprintf("Would set %s of group %s to %q, it is %q", name, pair.Group, want[name], have[name]))
+		} else {
+			writeInfo(fmt.Sprintf("Setting %s of group %s to %q, it was %q", name, pair.Group, want[name], have[name]))
+		}
+	}
+	if len(changed) == 0 || config.DryRun {
+		return nil
+	}
+
+	if err := dc.ReplaceAttributes(pair.groupDN(), changed); err != nil {
+		return fmt.Errorf("unable to update group attributes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Prometheus counters and gauges, nil unless --metrics-addr is given so the methods below are no-ops by default
+var metrics *metricSet
+
+type metricSet struct {
+	mu        sync.Mutex
+	added     int
+	removed   int
+	errors    int
+	lastRun   time.Time
+	groupSize map[string]int
+}
+
+//Start an HTTP server exposing /metrics in the Prometheus text format
+func serveMetrics(addr string) {
+	metrics = &metricSet{groupSize: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metrics.serveHTTP)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			writeError(fmt.Errorf("metrics server stopped: %w", err))
+		}
+	}()
+	writeInfo(fmt.Sprintf("Serving metrics on %s/metrics", addr))
+}
+
+//Fold the counters of a completed run into the totals. Dry runs only update the error count and timestamp
+func (m *metricSet) recordRun(s *summary) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !config.DryRun {
+		m.added += s.Added
+		m.removed += s.Removed
+	}
+	m.errors += s.Errors
+	m.lastRun = time.Now()
+}
+
+//Record the membership count of group after a sync
+func (m *metricSet) setGroupSize(group string, size int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groupSize[group] = size
+}
+
+func (m *metricSet) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP adsync_users_added_total Users added to groups.")
+	fmt.Fprintln(w, "# TYPE adsync_users_added_total counter")
+	fmt.Fprintf(w, "adsync_users_added_total %d\n", m.added)
+	fmt.Fprintln(w, "# HELP adsync_users_removed_total Users removed from groups.")
+	fmt.Fprintln(w, "# TYPE adsync_users_removed_total counter")
+	fmt.Fprintf(w, "adsync_users_removed_total %d\n", m.removed)
+	fmt.Fprintln(w, "# HELP adsync_errors_total Errors encountered during sync runs.")
+	fmt.Fprintln(w, "# TYPE adsync_errors_total counter")
+	fmt.Fprintf(w, "adsync_errors_total %d\n", m.errors)
+	fmt.Fprintln(w, "# HELP adsync_last_run_timestamp Unix time the last sync run finished.")
+	fmt.Fprintln(w, "# TYPE adsync_last_run_timestamp gauge")
+	if !m.lastRun.IsZero() {
+		fmt.Fprintf(w, "adsync_last_run_timestamp %d\n", m.lastRun.Unix())
+	}
+	fmt.Fprintln(w, "# HELP adsync_group_size Members in each group after the last sync.")
+	fmt.Fprintln(w, "# TYPE adsync_group_size gauge")
+
+	groups := make([]string, 0, len(m.groupSize))
+	for x := range m.groupSize {
+		groups = append(groups, x)
+	}
+	sort.Strings(groups)
+	for _, x := range groups {
+		fmt.Fprintf(w, "adsync_group_size{group=%q} %d\n", x, m.groupSize[x])
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+//Email the run summary and the list of changed users. Failures are logged and never fail the sync
+func sendNotification(s *summary) {
+	mail := config.Notify.SMTP
+	if mail.Host == "" {
+		return
+	}
+	if config.Notify.NotifyOnChangeOnly && len(s.changes) == 0 && s.Errors == 0 {
+		return
+	}
+
+	port := mail.Port
+	if port == 0 {
+		port = 25
+	}
+
+	subject := fmt.Sprintf("adsync: %d added, %d removed, %d errors", s.Added, s.Removed, s.Errors)
+	if config.DryRun {
+		subject += " (dry run)"
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "AD users: %d\r\n", s.ADUsers)
+	fmt.Fprintf(&body, "Group members before: %d\r\n", s.GroupMembers)
+	fmt.Fprintf(&body, "Added: %d\r\n", s.Added)
+	fmt.Fprintf(&body, "Removed: %d\r\n", s.Removed)
+	fmt.Fprintf(&body, "Errors: %d\r\n", s.Errors)
+	if s.Discrepancies > 0 {
+		fmt.Fprintf(&body, "Discrepancies: %d\r\n", s.Discrepancies)
+	}
+	if len(s.changes) > 0 {
+		body.WriteString("\r\nChanges:\r\n")
+		for _, x := range s.changes {
+			body.WriteString("  " + x + "\r\n")
+		}
+	}
+
+	msg := "From: " + mail.From + "\r\n" +
+		"To: " + strings.Join(mail.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body.String()
+
+	var auth smtp.Auth
+	if mail.Username != "" {
+		auth = smtp.PlainAuth("", mail.Username, mail.Password, mail.Host)
+	}
+
+	addr := net.JoinHostPort(mail.Host, strconv.Itoa(port))
+	if err := smtp.SendMail(addr, auth, mail.From, mail.To, []byte(msg)); err != nil {
+		writeError(fmt.Errorf("unable to send notification email: %w", err))
+		return
+	}
+	writeInfo("Notification email sent to " + strings.Join(mail.To, ", "))
+}
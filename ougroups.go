@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+//OUGroups maintains one group per child OU of BaseDN, named from Name with {ou} replaced by the OU's name.
+//Each group is created in GroupDN when missing and holds the users of its OU
+type OUGroups struct {
+	BaseDN  string
+	GroupDN string
+	//Name is the group name template such as GRP-{ou}-Users
+	Name string
+}
+
+//Return the group name for the OU named ou
+func (g OUGroups) groupName(ou string) string {
+	return strings.ReplaceAll(g.Name, "{ou}", ou)
+}
+
+//Report the problems with the settings of g, naming them with prefix
+func (g OUGroups) validate(prefix string) []string {
+	var problems []string
+	if _, err := ldap.ParseDN(g.BaseDN); err != nil || g.BaseDN == "" {
+		problems = append(problems, prefix+".baseDN is required and must be a valid DN")
+	}
+	if _, err := ldap.ParseDN(g.GroupDN); err != nil || g.GroupDN == "" {
+		problems = append(problems, prefix+".groupDN is required and must be a valid DN")
+	}
+	if !strings.Contains(g.Name, "{ou}") {
+		problems = append(problems, prefix+".name must contain {ou}")
+	}
+	return problems
+}
+
+//Enumerate the child OUs of every OUGroups entry and return a pair per OU. An entry whose OUs can't be
+//listed is reported and skipped so the other pairs still run
+func ouPairs(dc directoryClient) ([]SyncPair, error) {
+	var pairs []SyncPair
+	var errs []error
+	for _, x := range config.ActiveDirectory.OUGroups {
+		ous, err := dc.ListOUs(x.BaseDN)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to list the OUs under %s: %w", x.BaseDN, err))
+			continue
+		}
+		writeInfo(fmt.Sprintf("%d OUs under %s get a group", len(ous), x.BaseDN))
+
+		for _, ou := range ous {
+			dn, err := ldap.ParseDN(ou)
+			if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+				errs = append(errs, fmt.Errorf("unable to read the name of OU %s", ou))
+				continue
+			}
+			pairs = append(pairs, SyncPair{
+				UserDN:  ou,
+				GroupDN: x.GroupDN,
+				Group:   x.groupName(dn.RDNs[0].Attributes[0].Value),
+				create:  true,
+			})
+		}
+	}
+	return pairs, joinErrors(errs)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+//The membership changes computed by adsync plan, which adsync apply makes exactly as written
+type changePlan struct {
+	Created time.Time
+	Version string
+	Groups  []plannedGroup
+
+	//strict applies the change limits as a real run would, so a plan never holds changes a sync would refuse
+	strict bool
+}
+
+//The changes planned for one group. Create is set when the group is missing and createGroup is enabled
+type plannedGroup struct {
+	Group   string
+	GroupDN string
+	Create  bool `json:",omitempty"`
+	Add     []string
+	Remove  []string
+}
+
+//The plan being built while adsync plan runs, nil otherwise
+var activePlan *changePlan
+
+//Report whether adsync check is running. It must have no side effects beyond its output, so the run
+//sends no notification and writes no audit records
+func probing() bool {
+	return activePlan != nil && !activePlan.strict
+}
+
+//Return the entry for the pair's group, adding it on first use
+func (p *changePlan) group(pair SyncPair) *plannedGroup {
+	for i := range p.Groups {
+		if p.Groups[i].GroupDN == pair.GroupDN && p.Groups[i].Group == pair.Group {
+			return &p.Groups[i]
+		}
+	}
+	p.Groups = append(p.Groups, plannedGroup{Group: pair.Group, GroupDN: pair.GroupDN})
+	return &p.Groups[len(p.Groups)-1]
+}
+
+//Remove the entry for the pair's group, whose sync failed after recording some of its changes. A group the
+//change limits refused would otherwise still be created by apply
+func (p *changePlan) drop(pair SyncPair) {
+	for i := range p.Groups {
+		if p.Groups[i].GroupDN == pair.GroupDN && p.Groups[i].Group == pair.Group {
+			p.Groups = append(p.Groups[:i], p.Groups[i+1:]...)
+			return
+		}
+	}
+}
+
+//Run a dry-run sync of every pair and write the changes it would make to path. Groups whose sync fails are
+//left out of the plan, and the error is returned once the plan is written
+func writePlan(ctx context.Context, path string) error {
+	activePlan = &changePlan{Created: time.Now().UTC(), Version: version, strict: true}
+	config.DryRun = true
+	syncErr := syncAll(ctx)
+
+	b, err := json.MarshalIndent(activePlan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to write plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write plan: %w", err)
+	}
+	writeInfo(fmt.Sprintf("Plan for %d groups written to %s", len(activePlan.Groups), path))
+	return syncErr
+}
+
+//Returned by adsync check when a group differs from its source, so the process exits with status 2
+var errDrift = errors.New("drift found")
+
+//Run a dry-run sync of every pair and print the changes it would make to stdout as JSON, listing only the
+//groups that have drifted. Logs go to stderr so stdout stays machine readable
+func checkDrift(ctx context.Context) error {
+	activePlan = &changePlan{Created: time.Now().UTC(), Version: version}
+	config.DryRun = true
+	syncErr := syncAll(ctx)
+
+	drift := struct {
+		Drift  int
+		Groups []plannedGroup
+	}{Groups: []plannedGroup{}}
+	for _, x := range activePlan.Groups {
+		if x.Create || len(x.Add) > 0 || len(x.Remove) > 0 {
+			drift.Groups = append(drift.Groups, x)
+			drift.Drift += len(x.Add) + len(x.Remove)
+		}
+	}
+	b, err := json.MarshalIndent(drift, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to write drift: %w", err)
+	}
+	fmt.Println(string(b))
+
+	if syncErr != nil {
+		return syncErr
+	}
+	if len(drift.Groups) > 0 {
+		return fmt.Errorf("%w in %d groups", errDrift, len(drift.Groups))
+	}
+	return nil
+}
+
+//Make the changes listed in the plan at path, without searching for users or checking the change limits again.
+//A change that fails is reported and the rest of the plan still applied
+func applyPlan(ctx context.Context, path string) (err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read plan: %w", err)
+	}
+	var plan changePlan
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return fmt.Errorf("plan %s is corrupt: %w", path, err)
+	}
+	if config.DryRun {
+		return errors.New("a plan cannot be applied with --dry-run, it is already the dry run's output")
+	}
+
+	stats = summary{start: time.Now()}
+	accountNames = make(map[string]string)
+	defer func() {
+		stats.Errors += errorCount(err)
+		stats.report()
+		metrics.recordRun(&stats)
+		sendNotification(&stats)
+	}()
+
+	//Members the plan adds are tracked for RemoveManagedOnly as in a normal sync
+	if err := loadState(); err != nil {
+		return err
+	}
+	defer func() {
+		if serr := saveState(); serr != nil {
+			err = joinErrors([]error{err, serr})
+		}
+	}()
+
+	l, err := connectWithRetry(ctx, &config.ActiveDirectory.Connection)
+	if err != nil {
+		return err
+	}
+	dc := &ldapClient{conn: l, settings: &config.ActiveDirectory.Connection}
+	defer dc.Close()
+
+	writeInfo(fmt.Sprintf("Applying the plan created at %s", plan.Created.Format(time.RFC3339)))
+	var errs []error
+	for _, x := range plan.Groups {
+		if ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("apply stopped before group %s: %w", x.Group, ctx.Err()))
+			break
+		}
+		pair := SyncPair{GroupDN: x.GroupDN, Group: x.Group}
+
+		if x.Create {
+			if err := dc.CreateGroup(x.GroupDN, x.Group); err != nil {
+				errs = append(errs, fmt.Errorf("group %s: unable to create group: %w", x.Group, err))
+				continue
+			}
+			writeInfo(fmt.Sprintf("Created group %s in %s", x.Group, x.GroupDN))
+		}
+
+		added, addErr := addUsersToGroup(ctx, dc, pair, x.Add)
+		stats.Added += added
+		removed, removeErr := removeUsersFromGroup(ctx, dc, pair, x.Remove)
+		stats.Removed += removed
+		writeInfo(fmt.Sprintf("%d users added to and %d removed from group %s", added, removed, x.Group))
+
+		if err := joinErrors([]error{addErr, removeErr}); err != nil {
+			var groupErrs syncErrors
+			if !errors.As(err, &groupErrs) {
+				groupErrs = syncErrors{err}
+			}
+			for _, e := range groupErrs {
+				errs = append(errs, fmt.Errorf("group %s: %w", x.Group, e))
+			}
+		}
+	}
+	return joinErrors(errs)
+}
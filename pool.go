@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//Several failures from one pool of directory operations
+type syncErrors []error
+
+func (e syncErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, x := range e {
+		msgs[i] = x.Error()
+	}
+	return fmt.Sprintf("%d operations failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+//Return nil for no errors, the error itself for one, and a syncErrors for more. Nested syncErrors are
+//flattened so every failure is counted once
+func joinErrors(errs []error) error {
+	var flat syncErrors
+	for _, x := range errs {
+		if nested, ok := x.(syncErrors); ok {
+			flat = append(flat, nested...)
+		} else if x != nil {
+			flat = append(flat, x)
+		}
+	}
+
+	switch len(flat) {
+	case 0:
+		return nil
+	case 1:
+		return flat[0]
+	}
+	return flat
+}
+
+//Return how many failures err holds
+func errorCount(err error) int {
+	if errs, ok := err.(syncErrors); ok {
+		return len(errs)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+//Run jobs across n goroutines, or one when n is less than one. A failed job doesn't stop the others, but once
+//ctx is cancelled no further jobs are started. The error of every job that failed is returned along with any
+//cancellation
+func runPool(ctx context.Context, n int, jobs []func() error) []error {
+	if n < 1 {
+		n = 1
+	}
+
+	var mu sync.Mutex
+	var errs []error
+
+	queue := make(chan func() error)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := job(); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var cancelled error
+	for _, job := range jobs {
+		if cancelled = ctx.Err(); cancelled != nil {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if cancelled != nil {
+		errs = append(errs, cancelled)
+	}
+
+	return errs
+}
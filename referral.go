@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+//Run a search on the main connection. When the server answers with a referral to another domain it is either
+//followed, when ChaseReferrals is set, or logged and the referral error returned so callers can treat the
+//object as unresolvable rather than failing the run
+func (c *ldapClient) lookup(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result, err := c.conn.Search(req)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		return result, err
+	}
+
+	ref := referralURL(err)
+	if ref == "" || !config.ActiveDirectory.ChaseReferrals {
+		writeInfo(fmt.Sprintf("Unable to resolve %s, the server returned a referral to %q", req.BaseDN, ref), logField{"dn", req.BaseDN})
+		return nil, err
+	}
+
+	result, ferr := c.followReferral(ref, req, 1)
+	if ferr != nil {
+		writeInfo(fmt.Sprintf("Unable to follow the referral to %s for %s: %v", ref, req.BaseDN, ferr), logField{"dn", req.BaseDN})
+		return nil, err
+	}
+	return result, nil
+}
+
+//Repeat req against the server named in the referral URL ref, binding with the configured account. A referred
+//server that refers the search on again is followed too, hop counting the referrals so far, until
+//ReferralHops is reached
+func (c *ldapClient) followReferral(ref string, req *ldap.SearchRequest, hop int) (*ldap.SearchResult, error) {
+	conn, referred, err := c.referred(ref, req)
+	if err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(referred)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		return result, err
+	}
+
+	next := referralURL(err)
+	if next == "" || hop >= config.ActiveDirectory.ReferralHops {
+		return nil, fmt.Errorf("%s referred the search on after %d referrals: %w", ref, hop, err)
+	}
+	return c.followReferral(next, req, hop+1)
+}
+
+//Search the servers named by the search continuation references refs with req, paging through the results,
+//and return the entries found. References those servers return in turn are followed until ReferralHops is
+//reached, past which they are logged and skipped so a referral loop can't run forever
+func (c *ldapClient) searchReferrals(refs []string, req *ldap.SearchRequest, hop int) ([]*ldap.Entry, error) {
+	var entries []*ldap.Entry
+	for _, ref := range refs {
+		if hop > config.ActiveDirectory.ReferralHops {
+			writeInfo(fmt.Sprintf("Not following the referral to %s, %d referrals were already followed", ref, hop-1))
+			continue
+		}
+		conn, referred, err := c.referred(ref, req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to follow the referral to %s: %w", ref, err)
+		}
+		writeDebug(fmt.Sprintf("Searching %s on %s", referred.BaseDN, ref))
+		result, err := c.pagedSearch(conn, referred)
+		if err != nil {
+			return nil, fmt.Errorf("ldap search error following the referral to %s: %w", ref, err)
+		}
+		entries = append(entries, result.Entries...)
+
+		more, err := c.searchReferrals(result.Referrals, req, hop+1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, more...)
+	}
+	return entries, nil
+}
+
+//Return the connection to the server named in the referral URL ref, opening it on first use and keeping it
+//for the rest of the run, and a copy of req searching from the DN the URL names. The server is reached with
+//the scheme and port of the URL. A plain ldap:// referral from a TLS connection is upgraded with StartTLS,
+//since AD writes its referrals that way even to LDAPS clients and the bind must not go out in the clear
+func (c *ldapClient) referred(ref string, req *ldap.SearchRequest) (*ldap.Conn, *ldap.SearchRequest, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid referral: %w", err)
+	}
+	entry := strings.ToLower(u.Scheme) + "://" + u.Host
+
+	c.referralMu.Lock()
+	defer c.referralMu.Unlock()
+	conn, ok := c.referrals[entry]
+	if !ok {
+		writeDebug("Following referral to " + entry)
+		settings := *c.settings
+		settings.catalog = false
+		if _, secure := c.conn.TLSConnectionState(); secure {
+			settings.StartTLS = strings.EqualFold(u.Scheme, "ldap")
+		} else if strings.EqualFold(u.Scheme, "ldaps") {
+			settings.StartTLS = false
+		}
+		conn, err = connect(&settings, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.referrals == nil {
+			c.referrals = make(map[string]*ldap.Conn)
+		}
+		c.referrals[entry] = conn
+	}
+
+	//The path of an LDAP URL is the DN to search from on the referred server. The paging control of the
+	//original search carries a cookie only its server understands, so the copy starts without one
+	referred := *req
+	referred.Controls = nil
+	if dn := u.Path; len(dn) > 1 {
+		referred.BaseDN = dn[1:]
+	}
+	return conn, &referred, nil
+}
+
+//Close the connection and those opened while following referrals. It is safe to call more than once and
+//while a referral is being followed
+func (c *ldapClient) Close() {
+	c.conn.Close()
+
+	c.referralMu.Lock()
+	defer c.referralMu.Unlock()
+	for _, x := range c.referrals {
+		x.Close()
+	}
+	c.referrals = nil
+}
+
+//Extract the first referral URL from an LDAP error with the referral result code. The URLs are carried in the
+//context-specific [3] element of the LDAPResult
+func referralURL(err error) string {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.Packet == nil || len(ldapErr.Packet.Children) < 2 {
+		return ""
+	}
+
+	for _, x := range ldapErr.Packet.Children[1].Children {
+		if x.ClassType != ber.ClassContext || x.Tag != 3 {
+			continue
+		}
+		for _, uri := range x.Children {
+			if s, ok := uri.Value.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
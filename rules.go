@@ -0,0 +1,88 @@
+package main
+
+import "strings"
+
+//Rule routes the users under activeDirectory.userDN that satisfy Match or Expression into a group
+type Rule struct {
+	//Match is an attribute=value test such as department=Finance, compared ignoring case against every
+	//value of a multi-valued attribute
+	Match string
+	//Expression is used in place of Match for tests over several attributes, see expression
+	Expression string
+	GroupDN    string
+	Group      string
+
+	program *expression
+}
+
+//Compile Expression, once at startup, so every user is evaluated against the same program
+func (r *Rule) compile() error {
+	if r.Expression == "" {
+		return nil
+	}
+	program, err := compileExpression(r.Expression)
+	if err != nil {
+		return err
+	}
+	r.program = program
+	return nil
+}
+
+//The text of the test applied by the rule, for log messages
+func (r *Rule) String() string {
+	if r.Expression != "" {
+		return r.Expression
+	}
+	return r.Match
+}
+
+//Split Match into its attribute and value, reporting false when it is not of the form attribute=value
+func (r *Rule) parse() (string, string, bool) {
+	i := strings.Index(r.Match, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(r.Match[:i]), strings.TrimSpace(r.Match[i+1:]), true
+}
+
+//Report whether the user satisfies the rule. Only expressions can fail to evaluate
+func (r *Rule) matches(u directoryUser) (bool, error) {
+	if r.program != nil {
+		return r.program.eval(u)
+	}
+
+	attr, value, ok := r.parse()
+	if !ok {
+		return false, nil
+	}
+	for _, x := range u.Attributes[strings.ToLower(attr)] {
+		if strings.EqualFold(strings.TrimSpace(x), value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//Return every attribute the rules test, so a single user search can serve all of them
+func (c *Configuration) ruleAttributes() []string {
+	var attrs []string
+	seen := make(map[string]struct{})
+	add := func(attr string) {
+		if _, dup := seen[strings.ToLower(attr)]; !dup {
+			seen[strings.ToLower(attr)] = struct{}{}
+			attrs = append(attrs, attr)
+		}
+	}
+
+	for i := range c.ActiveDirectory.Rules {
+		rule := &c.ActiveDirectory.Rules[i]
+		if rule.program != nil {
+			for _, x := range rule.program.attrs {
+				add(x)
+			}
+		} else if attr, _, ok := rule.parse(); ok {
+			add(attr)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//Read the users listed in column of the CSV file at path. The first row is a header and column names the
+//header to read, case-insensitively; when column is empty the first column is used
+func readCSVUsers(path, column string) ([]directoryUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open source CSV: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse source CSV %s: %w", path, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("source CSV %s is empty", path)
+	}
+
+	index, err := csvColumn(rows[0], column)
+	if err != nil {
+		return nil, fmt.Errorf("source CSV %s: %w", path, err)
+	}
+
+	var users []directoryUser
+	for _, x := range rows[1:] {
+		if index >= len(x) || strings.TrimSpace(x[index]) == "" {
+			continue
+		}
+		users = append(users, directoryUser{DN: x[index]})
+	}
+	return users, nil
+}
+
+//Find the index of column in the header row
+func csvColumn(header []string, column string) (int, error) {
+	if column == "" {
+		return 0, nil
+	}
+
+	for i, x := range header {
+		if strings.EqualFold(strings.TrimSpace(x), column) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no %q column in header", column)
+}
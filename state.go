@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//What is kept in StateFile between runs. Both maps are keyed by normalized group DN and then by member
+type syncState struct {
+	//StaleSince holds when each stale member was first found missing from the source. Only the members still
+	//stale are kept, so a user who returns starts a fresh grace period next time
+	StaleSince map[string]map[string]time.Time
+	//Managed holds when adsync added each member, for RemoveManagedOnly
+	Managed map[string]map[string]time.Time
+}
+
+var (
+	state syncState
+	//stateMu guards state.Managed, which the add and remove workers update concurrently
+	stateMu sync.Mutex
+)
+
+//Report whether anything needs StateFile
+func stateEnabled() bool {
+	return config.ActiveDirectory.RemoveAfterDays > 0 || config.ActiveDirectory.RemoveManagedOnly
+}
+
+//Read the state from StateFile when a setting needs it. A missing file is a first run
+func loadState() error {
+	state = syncState{
+		StaleSince: make(map[string]map[string]time.Time),
+		Managed:    make(map[string]map[string]time.Time),
+	}
+	if !stateEnabled() {
+		return nil
+	}
+
+	b, err := os.ReadFile(config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read state file: %w", err)
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("state file %s is corrupt: %w", config.StateFile, err)
+	}
+	if state.StaleSince == nil {
+		state.StaleSince = make(map[string]map[string]time.Time)
+	}
+	if state.Managed == nil {
+		state.Managed = make(map[string]map[string]time.Time)
+	}
+	return nil
+}
+
+//Write the state back to StateFile, through a temporary file so an interrupted write can't lose what is
+//already tracked. Dry runs leave the file alone
+func saveState() error {
+	if !stateEnabled() || config.DryRun {
+		return nil
+	}
+
+	stateMu.Lock()
+	b, err := json.MarshalIndent(state, "", "  ")
+	stateMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	tmp := config.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, config.StateFile); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	return nil
+}
+
+//Return the stale members of the pair's group that have been missing from the source for RemoveAfterDays,
+//noting the time the others were first seen stale
+func pastGracePeriod(pair SyncPair, stale []string) []string {
+	days := config.ActiveDirectory.RemoveAfterDays
+	if days <= 0 {
+		return stale
+	}
+
+	group := normalizeName(pair.groupDN())
+	previous := state.StaleSince[group]
+	current := make(map[string]time.Time, len(stale))
+	cutoff := time.Now().AddDate(0, 0, -days)
+	var due []string
+	for _, x := range stale {
+		since, ok := previous[x]
+		if !ok {
+			since = time.Now()
+		}
+		current[x] = since
+		if since.After(cutoff) {
+			writeDebug(fmt.Sprintf("Keeping %s, it has been stale since %s", x, since.Format(time.RFC3339)), logField{"user", x})
+			continue
+		}
+		due = append(due, x)
+	}
+	state.StaleSince[group] = current
+
+	if waiting := len(stale) - len(due); waiting > 0 {
+		writeInfo(fmt.Sprintf("%d stale members are kept until they have been missing for %d days", waiting, days))
+	}
+	return due
+}
+
+//Return the stale members of the pair's group that adsync added itself, leaving members added by hand alone.
+//Members no longer in the group are forgotten, so one added again by hand later stays unmanaged
+func managedOnly(pair SyncPair, stale []string) []string {
+	if !config.ActiveDirectory.RemoveManagedOnly {
+		return stale
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	group := normalizeName(pair.groupDN())
+	managed := state.Managed[group]
+	current := make(map[string]time.Time, len(managed))
+	for _, x := range groupUsers {
+		if added, ok := managed[x]; ok {
+			current[x] = added
+		}
+	}
+	state.Managed[group] = current
+
+	var owned []string
+	for _, x := range stale {
+		if _, ok := current[x]; !ok {
+			writeDebug(fmt.Sprintf("Keeping %s, it was not added by adsync", x), logField{"user", x})
+			continue
+		}
+		owned = append(owned, x)
+	}
+	if kept := len(stale) - len(owned); kept > 0 {
+		writeInfo(fmt.Sprintf("%d stale members were not added by adsync and are left in the group", kept))
+	}
+	return owned
+}
+
+//Note whether adsync added member to the pair's group, or removed it
+func markManaged(pair SyncPair, member string, added bool) {
+	if !config.ActiveDirectory.RemoveManagedOnly {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	group := normalizeName(pair.groupDN())
+	if !added {
+		delete(state.Managed[group], member)
+		return
+	}
+	if state.Managed[group] == nil {
+		state.Managed[group] = make(map[string]time.Time)
+	}
+	state.Managed[group][member] = time.Now()
+}
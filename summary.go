@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//Counters accumulated over a run. In dry-run mode Added and Removed count the changes that would have been made
+type summary struct {
+	ADUsers      int
+	GroupMembers int
+	Added        int
+	Removed      int
+	Errors       int
+	//Discrepancies counts the changes that VerifyMembership found missing from the group after the run
+	Discrepancies int
+	start         time.Time
+	//changes lists each applied or planned change as "action user group"
+	changes []string
+	//failed holds each change whose modify failed, keyed by action, user and group joined by NULs
+	failed map[string]struct{}
+}
+
+//Write the summary block to the info log, which includes stdout unless the console is disabled
+func (s *summary) report() {
+	mode := ""
+	if config.DryRun {
+		mode = " (dry run)"
+	}
+
+	lines := []string{
+		"Sync summary" + mode,
+		fmt.Sprintf("  AD users:              %d", s.ADUsers),
+		fmt.Sprintf("  Group members before:  %d", s.GroupMembers),
+		fmt.Sprintf("  Added:                 %d", s.Added),
+		fmt.Sprintf("  Removed:               %d", s.Removed),
+		fmt.Sprintf("  Errors:                %d", s.Errors),
+		fmt.Sprintf("  Discrepancies:         %d", s.Discrepancies),
+		fmt.Sprintf("  Elapsed:               %s", time.Since(s.start).Round(time.Millisecond)),
+	}
+
+	//The summary is logged at every level so a quiet run still records its outcome
+	if infoLogger != nil {
+		for _, x := range lines {
+			writeEntry(infoLogger, "info", x, nil)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "fmt"
+
+//Read the pair's group back and check that every user added to it is now a member and every user removed is
+//not. Changes whose modify failed were already reported and are skipped. Each discrepancy is logged and
+//counted, and an error returned when there are any
+func verifyGroup(dc directoryClient, pair SyncPair, added, removed []string) error {
+	members, _, err := dc.ListGroupMembers(pair.GroupDN, pair.Group)
+	if err != nil {
+		return fmt.Errorf("unable to verify group membership: %w", err)
+	}
+	present := make(map[string]struct{}, len(members))
+	for _, x := range members {
+		present[memberName(x)] = struct{}{}
+	}
+
+	auditMu.Lock()
+	failed := func(action, user string) bool {
+		_, ok := stats.failed[action+"\x00"+user+"\x00"+pair.Group]
+		return ok
+	}
+	var missing, remaining []string
+	for _, x := range added {
+		if _, ok := present[x]; !ok && !failed("add", x) {
+			missing = append(missing, x)
+		}
+	}
+	for _, x := range removed {
+		if _, ok := present[x]; ok && !failed("remove", x) {
+			remaining = append(remaining, x)
+		}
+	}
+	auditMu.Unlock()
+
+	for _, x := range missing {
+		writeError(fmt.Errorf("%s was added to group %s but is not a member", x, pair.Group))
+	}
+	for _, x := range remaining {
+		writeError(fmt.Errorf("%s was removed from group %s but is still a member", x, pair.Group))
+	}
+
+	n := len(missing) + len(remaining)
+	stats.Discrepancies += n
+	if n > 0 {
+		return fmt.Errorf("verification found %d changes to group %s that did not take effect", n, pair.Group)
+	}
+	writeInfo(fmt.Sprintf("Verified the membership of group %s", pair.Group))
+	return nil
+}